@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/davidporter-id-au/small-join/smalljoin"
+)
+
+// the flags for one side's CSV dialect, which override the -dialect preset
+// when they're given
+type dialectFlags struct {
+	side      string
+	quote     string
+	escape    string
+	comment   string
+	trimSpace bool
+	strict    bool
+}
+
+func registerDialectFlags(flags *flag.FlagSet, side string, description string) *dialectFlags {
+	d := &dialectFlags{side: side}
+	flags.StringVar(&d.quote, side+"-quote", `"`, "the character which quotes a column of "+description)
+	flags.StringVar(&d.escape, side+"-escape", "default", "options: [default|doubled|backslash] how quotes are escaped in "+description+". \n'default' doubles them, and with -clean also allows \\\" unless it's at the end of a column")
+	flags.StringVar(&d.comment, side+"-comment", "", "skip rows of "+description+" which start with this prefix, eg #")
+	flags.BoolVar(&d.trimSpace, side+"-trim-space", false, "ignore leading spaces in the columns of "+description)
+	flags.BoolVar(&d.strict, side+"-strict-quotes", false, "fail rows of "+description+" with stray or unclosed quotes, rather than keeping them as part of a column")
+	return d
+}
+
+// resolves the dialect, starting from the preset (if there is one)
+// and applying whichever of the side's flags were given
+func (d *dialectFlags) dialect(flags *flag.FlagSet, preset string) (smalljoin.CSVDialect, error) {
+	var dialect smalljoin.CSVDialect
+	if preset != "" {
+		var err error
+		dialect, err = smalljoin.CSVDialectPreset(preset)
+		if err != nil {
+			return dialect, err
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		switch strings.TrimPrefix(f.Name, d.side+"-") {
+		case "quote":
+			if utf8.RuneCountInString(d.quote) != 1 {
+				err = fmt.Errorf("not a valid -%s-quote %q, it should be a single character", d.side, d.quote)
+				return
+			}
+			dialect.Quote, _ = utf8.DecodeRuneInString(d.quote)
+		case "escape":
+			switch strings.ToLower(d.escape) {
+			case "default":
+				dialect.Escape = smalljoin.EscapeDefault
+			case "doubled":
+				dialect.Escape = smalljoin.EscapeDoubled
+			case "backslash":
+				dialect.Escape = smalljoin.EscapeBackslash
+			default:
+				err = fmt.Errorf("not a valid -%s-escape %q, options are: 'default', 'doubled', 'backslash'", d.side, d.escape)
+			}
+		case "comment":
+			dialect.Comment = d.comment
+		case "trim-space":
+			dialect.TrimLeadingSpace = d.trimSpace
+		case "strict-quotes":
+			dialect.Strict = d.strict
+		}
+	})
+	return dialect, err
+}
@@ -1,6 +1,6 @@
 module github.com/davidporter-id-au/small-join
 
-go 1.17
+go 1.21
 
 require (
 	github.com/jmespath/go-jmespath v0.4.0
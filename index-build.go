@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/davidporter-id-au/small-join/smalljoin"
+)
+
+// small-join index build: parses an index file once and writes out
+// a prebuilt index of it, for use with -right-index
+func buildIndex(args []string) {
+	var rightIndexFile string
+	var output string
+	var duplicatesStr string
+	var rSeparator string
+	var rJsonSubqueries stringListFlag
+	var rJoinColumnStr string
+	var rHeader bool
+	var attemptToClean bool
+	var bloomFalsePositiveRate float64
+	var dialectStr string
+	var rFormatStr string
+	var rJSONArrayPath string
+
+	flags := flag.NewFlagSet("index build", flag.ExitOnError)
+	flags.StringVar(&rightIndexFile, "right", "", "the index file to build a prebuilt index of")
+	flags.StringVar(&output, "o", "", "the path to write the prebuilt index to")
+	flags.StringVar(&duplicatesStr, "right-duplicates", "all", "options: [all|first|last|error] what to do when a key appears several times in the index file")
+	flags.Float64Var(&bloomFalsePositiveRate, "bloom-fp-rate", 0, "if set (eg, 0.01), store a bloom filter of the index's keys with this false positive rate in the index")
+	flags.BoolVar(&attemptToClean, "clean", true, "try to clean up data before joining")
+	flags.StringVar(&rSeparator, "right-separator", "", "a separator for the index file's columns with which to split it (eg, a comman for CSVs). \n'auto' detects it, how columns are quoted and whether there's a header from the first rows")
+	flags.Var(&rJsonSubqueries, "right-json-subquery", "the JMES path to query and do a join on (if the contents of the column are JSON). Can be repeated to join on a composite key")
+	flags.StringVar(&rJoinColumnStr, "right-column", "-1", "the column number with which to attempt to join on. A comma separated list of columns joins on a composite key")
+	flags.BoolVar(&rHeader, "right-header", false, "the first row of the index file is a header of column names")
+	flags.StringVar(&rFormatStr, "right-format", "delimited", "options: [delimited|ndjson|json] 'ndjson' decodes each row of the index file as JSON, to join on -right-json-subquery. \n'json' does the same for the elements of a top-level array, or for concatenated (eg pretty-printed) values")
+	flags.StringVar(&rJSONArrayPath, "right-json-array", "", "with -right-format json, a JMESPath of field names (eg, data.items) to the array of rows inside each value")
+	rDialectFlags := registerDialectFlags(flags, "right", "the index file")
+	flags.StringVar(&dialectStr, "dialect", "", "options: [rfc4180|excel|postgres|mysql] a preset for how the index file's CSV columns are quoted")
+	flags.Parse(args)
+
+	if rightIndexFile == "" || output == "" {
+		log.Fatalf("both -right and -o are required to build an index")
+	}
+	if _, err := os.Stat(rightIndexFile); err != nil {
+		log.Fatalf("Could not read right join file: %v, file: %q", err, rightIndexFile)
+	}
+
+	rJoinColumns, rJoinColumnNames := parseColumnList(rJoinColumnStr)
+	if rJoinColumnNames != nil && !rHeader && rSeparator != smalljoin.SeparatorAuto {
+		log.Fatalf("not a valid right join column %q, columns can only be given by name with -right-header, or a detected header with -right-separator auto", rJoinColumnStr)
+	}
+
+	rDialect, err := rDialectFlags.dialect(flags, dialectStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = smalljoin.BuildIndexFile(rightIndexFile, output, smalljoin.QueryOptions{
+		JoinColumns:     rJoinColumns,
+		JoinColumnNames: rJoinColumnNames,
+		Header:          rHeader,
+		HeaderGiven:     flagGiven(flags, "right-header"),
+		Separator:       rSeparator,
+		JsonSubqueries:  rJsonSubqueries,
+		AttemptToClean:  attemptToClean,
+		Dialect:         rDialect,
+		Format:          parseFormat("right", rFormatStr),
+		JSONArrayPath:   rJSONArrayPath,
+	}, parseDuplicates(duplicatesStr), bloomFalsePositiveRate)
+	if err != nil {
+		log.Fatalf("Fatal error while building index: %s", err)
+	}
+}
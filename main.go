@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"log"
 	"os"
@@ -11,47 +21,130 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "index" && os.Args[2] == "build" {
+		buildIndex(os.Args[3:])
+		return
+	}
 
 	var joinStr string
 	var join smalljoin.Jointype
 	var rightIndexFile string
+	var prebuiltIndex string
+	var allowStaleIndex bool
+	var verifyIndexChecksum bool
+	var sortedInputs bool
+	var maxMemoryStr string
+	var bloomFalsePositiveRate float64
+	var preserveOrder bool
+	var leftFile string
+	var outputPath string
+	var checkpointPath string
+	var checkpointInterval time.Duration
+	var resume bool
+	var maxErrors int64
+	var maxErrorRate float64
+	var rejectFile string
 	var rightExecStr string
+	var duplicatesStr string
+	var indexModeStr string
+	var indexMode smalljoin.IndexMode
 
 	var lSeparator string
-	var lJsonSubquery string
-	var lJoinColumn int
+	var lJsonSubqueries stringListFlag
+	var lJoinColumnStr string
+	var lHeader bool
 
 	var rSeparator string
-	var rJsonSubquery string
-	var rJoinColumn int
+	var rJsonSubqueries stringListFlag
+	var rJoinColumnStr string
+	var rHeader bool
 	var debugMode bool
+	var logFormatStr string
+	var statsFormat string
+	var progress bool
+	var progressInterval time.Duration
+	var inputSizeStr string
+	var metricsAddr string
+	var dialectStr string
+	var lFormatStr string
+	var rFormatStr string
+	var lJSONArrayPath string
+	var rJSONArrayPath string
+	var statsFile string
 	var continueOnError bool
 	var attemptToClean bool
 
 	flag.StringVar(&rightIndexFile, "right", "", "the right side of the join file with the incoming stream, ie the indexes to read in")
+	flag.StringVar(&prebuiltIndex, "right-index", "", "a prebuilt index file, created with 'small-join index build', to use for the right side of the join")
+	flag.BoolVar(&allowStaleIndex, "allow-stale-index", false, "only warn, rather than refuse, when the prebuilt index's source file has changed since it was built")
+	flag.BoolVar(&verifyIndexChecksum, "verify-index-checksum", false, "check the prebuilt index's source file hasn't changed by its checksum, which reads the whole file, \nrather than by its size and modification time")
 	flag.StringVar(&rightExecStr, "right-exec-with-exit-code", "", "A bash string to execute to execute for each line, to attempt to join on")
-	flag.StringVar(&joinStr, "join", "inner", "options: [inner|left|right-is-null] The 'sql' type of join to apply on the two data streams")
+	flag.StringVar(&joinStr, "join", "inner", "options: [inner|left|right-is-null|right|full|left-is-null] The 'sql' type of join to apply on the two data streams")
+	flag.StringVar(&duplicatesStr, "right-duplicates", "all", "options: [all|first|last|error] what to do when a key appears several times in the index file. 'all' emits one result per matching row")
+	flag.StringVar(&indexModeStr, "right-index-mode", "memory", "options: [memory|disk] 'disk' keeps only the keys and file offsets of the index file in memory and reads rows from the file as needed, for index files larger than memory")
+	flag.BoolVar(&sortedInputs, "sorted", false, "both the incoming stream and the index file are sorted by their join keys (as with `LC_ALL=C sort`), \nso merge join them in constant memory rather than reading the index into memory")
+	flag.StringVar(&maxMemoryStr, "max-memory", "", "a memory budget for the index, eg 512MB or 2GB. If the index would be larger, \nboth sides are partitioned into buckets on disk and joined a bucket at a time")
+	flag.Float64Var(&bloomFalsePositiveRate, "bloom-fp-rate", 0, "if set (eg, 0.01), build a bloom filter of the index's keys with this false positive rate, \nto reject most rows of the stream which don't match without an index lookup")
+	flag.BoolVar(&preserveOrder, "preserve-order", false, "write results out in the same order as the incoming stream, while still joining concurrently")
+	flag.StringVar(&leftFile, "left-file", "", "read the incoming stream from this file, rather than stdin")
+	flag.StringVar(&outputPath, "output", "", "write the results to this file, rather than stdout")
+	flag.StringVar(&checkpointPath, "checkpoint", "", "periodically record how far the join has got in this file, so that it can be resumed with -resume. \nRequires -left-file and -output, and implies -preserve-order")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", 10*time.Second, "how often to record a checkpoint")
+	flag.BoolVar(&resume, "resume", false, "carry on the join from where -checkpoint says it got to, cutting the output back to match")
 	flag.BoolVar(&debugMode, "verbose", false, "output debug information")
+	flag.StringVar(&statsFormat, "stats", "", "options: [table|json] once the join finishes, write out statistics about it, such as how many rows were matched")
+	flag.BoolVar(&progress, "progress", false, "periodically write out how far the join has got on stderr, \nwith the percentage done and an ETA if the input is a file or -input-size is given")
+	flag.DurationVar(&progressInterval, "progress-interval", 2*time.Second, "how often to write out -progress")
+	flag.StringVar(&inputSizeStr, "input-size", "", "the size of the incoming stream, eg 20GB, for -progress to give an ETA when it's read from a pipe")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve metrics in the Prometheus text format on /metrics, and Go's profiles on /debug/pprof/, \nat this address (eg, 127.0.0.1:9090) while the join runs")
+	flag.StringVar(&statsFile, "stats-file", "", "write the -stats to this file, rather than stderr")
+	flag.StringVar(&logFormatStr, "log-format", "text", "options: [text|json] how to write out logs on stderr. Text is only coloured when stderr is a terminal")
 	flag.BoolVar(&continueOnError, "continue", false, "continue on error")
+	flag.Int64Var(&maxErrors, "max-errors", 0, "skip rows which can't be joined, failing once there are more than this many of them \n(0 fails on the first once it's written to -reject-file, and -1 skips them with no limit, as with -continue)")
+	flag.Float64Var(&maxErrorRate, "max-error-rate", 0, "skip rows which can't be joined, failing once more than this fraction (eg, 0.01) of the rows read can't be")
+	flag.StringVar(&rejectFile, "reject-file", "", "write rows which can't be joined, and why, to this file as newline delimited JSON")
 	flag.BoolVar(&attemptToClean, "clean", true, "try to clean up data before joining")
 
-	flag.StringVar(&lSeparator, "left-separator", ",", "a separator for the incoming stream")
-	flag.StringVar(&lJsonSubquery, "left-json-subquery", "", "the JMES path to query and do a join on")
-	flag.IntVar(&lJoinColumn, "left-join-column", -1, "the column number with which to attempt to join on. -1 imples there's no columns and to join on the entire row")
+	flag.StringVar(&lSeparator, "left-separator", ",", "a separator for the incoming stream. \n'auto' detects it, how columns are quoted and whether there's a header from the first rows")
+	flag.Var(&lJsonSubqueries, "left-json-subquery", "the JMES path to query and do a join on. Can be repeated to join on a composite key")
+	flag.StringVar(&lJoinColumnStr, "left-join-column", "-1", "the column number with which to attempt to join on. -1 imples there's no columns and to join on the entire row. \nA comma separated list of columns (eg, 2,5) joins on a composite key. \nColumns may be given by name with -left-header")
+	flag.BoolVar(&lHeader, "left-header", false, "the first row of the incoming stream is a header of column names")
+	flag.StringVar(&lFormatStr, "left-format", "delimited", "options: [delimited|ndjson|json] 'ndjson' decodes each row of the incoming stream as JSON just once, \nto join on -left-json-subquery, and outputs it as JSON rather than a string. \n'json' does the same for the elements of a top-level array, or for concatenated (eg pretty-printed) values")
+	flag.StringVar(&lJSONArrayPath, "left-json-array", "", "with -left-format json, a JMESPath of field names (eg, data.items) to the array of rows inside each value")
+	lDialectFlags := registerDialectFlags(flag.CommandLine, "left", "the incoming stream")
 
-	flag.StringVar(&rSeparator, "right-separator", "", "a separator for the index file's columns with which to split it (eg, a comman for CSVs)")
-	flag.StringVar(&rJsonSubquery, "right-json-subquery", "", "the JMES path to query and do a join on (if the contents of the column are JSON)")
-	flag.IntVar(&rJoinColumn, "right-column", -1, "the column number with which to attempt to join on if there's a need to join only on a single column. \n-1 implies there's no clumns and join on the entire row")
+	flag.StringVar(&rSeparator, "right-separator", "", "a separator for the index file's columns with which to split it (eg, a comman for CSVs). \n'auto' detects it, how columns are quoted and whether there's a header from the first rows")
+	flag.Var(&rJsonSubqueries, "right-json-subquery", "the JMES path to query and do a join on (if the contents of the column are JSON). Can be repeated to join on a composite key")
+	flag.StringVar(&rJoinColumnStr, "right-column", "-1", "the column number with which to attempt to join on if there's a need to join only on a single column. \n-1 implies there's no clumns and join on the entire row. A comma separated list of columns joins on a composite key. \nColumns may be given by name with -right-header")
+	flag.BoolVar(&rHeader, "right-header", false, "the first row of the index file is a header of column names")
+	flag.StringVar(&rFormatStr, "right-format", "delimited", "options: [delimited|ndjson|json] 'ndjson' decodes each row of the index file as JSON, \nto join on -right-json-subquery, and outputs it as JSON rather than a string. \n'json' does the same for the elements of a top-level array, or for concatenated (eg pretty-printed) values")
+	flag.StringVar(&rJSONArrayPath, "right-json-array", "", "with -right-format json, a JMESPath of field names (eg, data.items) to the array of rows inside each value")
+	rDialectFlags := registerDialectFlags(flag.CommandLine, "right", "the index file")
+	flag.StringVar(&dialectStr, "dialect", "", "options: [rfc4180|excel|postgres|mysql] a preset for how both sides' CSV columns are quoted, \nwhich the -left-/-right- quote, escape, comment, trim-space and strict-quotes flags override")
 
 	flag.Parse()
 
-	if rightIndexFile != "" && rightExecStr != "" {
+	if (rightIndexFile != "" || prebuiltIndex != "") && rightExecStr != "" {
 		log.Fatalf("Only an index file or exec string can be specified, not both")
 	}
 
-	if rightIndexFile == "" && rightExecStr == "" {
+	if rightIndexFile == "" && prebuiltIndex == "" && rightExecStr == "" {
 		log.Fatalf("An input from the right-side of the on is required. Use --help to see options")
 	}
+	if prebuiltIndex != "" {
+		// the index was built with these, so they'd be ignored
+		for _, name := range []string{"right-separator", "right-json-subquery", "right-column", "right-header", "right-format",
+			"right-json-array", "right-duplicates", "right-quote", "right-escape", "right-comment", "right-trim-space", "right-strict-quotes"} {
+			if flagGiven(flag.CommandLine, name) {
+				log.Fatalf("-%s can't be given with -right-index, as the options of the right side are those the index was built with", name)
+			}
+		}
+		for _, name := range []string{"right-index-mode", "max-memory"} {
+			if flagGiven(flag.CommandLine, name) {
+				log.Fatalf("-%s can't be given with -right-index, as a prebuilt index is always loaded whole, with its rows read from the source file as they're needed", name)
+			}
+		}
+	}
 	if rightIndexFile != "" {
 		s, err := os.Stat(rightIndexFile)
 		if err != nil {
@@ -62,6 +155,13 @@ func main() {
 		}
 	}
 
+	if checkpointPath != "" && (leftFile == "" || outputPath == "") {
+		log.Fatalf("-checkpoint requires the incoming stream to be read with -left-file and the results written with -output")
+	}
+	if resume && checkpointPath == "" {
+		log.Fatalf("-resume requires the -checkpoint to resume from")
+	}
+
 	switch strings.ToLower(joinStr) {
 	case "inner":
 		join = smalljoin.JoinTypeInner
@@ -69,36 +169,416 @@ func main() {
 		join = smalljoin.JoinTypeLeft
 	case "right-is-null":
 		join = smalljoin.JoinTypeRightIsNull
+	case "right":
+		join = smalljoin.JoinTypeRight
+	case "full":
+		join = smalljoin.JoinTypeFull
+	case "left-is-null":
+		join = smalljoin.JoinTypeLeftIsNull
 	default:
-		log.Fatalf("not a valid join %q, options are: 'inner', 'left', 'right-is-null'\n", joinStr)
+		log.Fatalf("not a valid join %q, options are: 'inner', 'left', 'right-is-null', 'right', 'full', 'left-is-null'\n", joinStr)
+	}
+
+	duplicates := parseDuplicates(duplicatesStr)
+
+	lJoinColumns, lJoinColumnNames := parseColumnList(lJoinColumnStr)
+	if lJoinColumnNames != nil && !lHeader && lSeparator != smalljoin.SeparatorAuto {
+		log.Fatalf("not a valid left join column %q, columns can only be given by name with -left-header, or a detected header with -left-separator auto", lJoinColumnStr)
+	}
+	rJoinColumns, rJoinColumnNames := parseColumnList(rJoinColumnStr)
+	if rJoinColumnNames != nil && !rHeader && rSeparator != smalljoin.SeparatorAuto {
+		log.Fatalf("not a valid right join column %q, columns can only be given by name with -right-header, or a detected header with -right-separator auto", rJoinColumnStr)
+	}
+
+	lDialect, err := lDialectFlags.dialect(flag.CommandLine, dialectStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rDialect, err := rDialectFlags.dialect(flag.CommandLine, dialectStr)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	switch strings.ToLower(indexModeStr) {
+	case "memory":
+		indexMode = smalljoin.IndexInMemory
+	case "disk":
+		indexMode = smalljoin.IndexOnDisk
+	default:
+		log.Fatalf("not a valid index mode %q, options are: 'memory', 'disk'\n", indexModeStr)
+	}
+
+	maxMemory, err := parseByteSize(maxMemoryStr)
+	if err != nil {
+		log.Fatalf("not a valid memory budget %q: %v", maxMemoryStr, err)
+	}
+
+	input := os.Stdin
+	if leftFile != "" {
+		input, err = os.Open(leftFile)
+		if err != nil {
+			log.Fatalf("Could not read left file: %v", err)
+		}
+	}
+	var maxErrorsBudget *int64
+	if flagGiven(flag.CommandLine, "max-errors") {
+		switch {
+		case maxErrors == -1:
+			continueOnError = true
+		case maxErrors >= 0:
+			maxErrorsBudget = &maxErrors
+		default:
+			log.Fatalf("not a valid max errors %d, it needs to be 0 or more, or -1 for no limit", maxErrors)
+		}
+	}
+	if !(maxErrorRate >= 0 && maxErrorRate <= 1) {
+		log.Fatalf("not a valid max error rate %v, it needs to be between 0 and 1", maxErrorRate)
+	}
+	if progressInterval <= 0 {
+		log.Fatalf("not a valid progress interval %v, it needs to be more than 0", progressInterval)
+	}
+	inputSize, err := parseByteSize(inputSizeStr)
+	if err != nil {
+		log.Fatalf("not a valid input size %q: %v", inputSizeStr, err)
+	}
+	if inputSize == 0 {
+		inputSize = inputFileSize(input)
+	}
+	var resumeFrom *smalljoin.Checkpoint
+	if resume {
+		resumeFrom, err = smalljoin.ReadCheckpoint(checkpointPath)
+		if err != nil {
+			log.Fatalf("Could not resume the join: %v", err)
+		}
+	}
+	outFile := os.Stdout
+	if outputPath != "" {
+		outFile, err = openOutput(outputPath, resumeFrom)
+		if err != nil {
+			log.Fatalf("Could not open output file: %v", err)
+		}
+		defer outFile.Close()
+	}
+
+	stderr := &statusWriter{w: os.Stderr}
+	logger := newLogger(stderr, logFormatStr, debugMode)
+	switch statsFormat {
+	case "", "table", "json":
+	default:
+		log.Fatalf("not a valid stats format %q, options are: 'table', 'json'\n", statsFormat)
+	}
+
+	var rejects *bufio.Writer
+	if rejectFile != "" {
+		f, err := openRejects(rejectFile, resumeFrom != nil)
+		if err != nil {
+			log.Fatalf("Could not open reject file: %v", err)
+		}
+		defer f.Close()
+		rejects = bufio.NewWriter(f)
+	}
+
+	// the first interrupt stops reading the incoming stream and finishes off
+	// what's already being joined, a second one kills it outright
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	output := bufferedOutput{Writer: bufio.NewWriter(outFile), file: outFile}
 	joiner := smalljoin.New(
-		os.Stdin,
-		os.Stdout,
+		input,
+		output,
 		os.Stderr,
 		smalljoin.Options{
-			IndexFile:       rightIndexFile,
-			RightExecStr:    rightExecStr,
-			Jointype:        join,
-			OutputDebugMode: debugMode,
-			ContinueOnErr:   continueOnError,
+			IndexFile:           rightIndexFile,
+			RightExecStr:        rightExecStr,
+			Jointype:            join,
+			DuplicateKeys:       duplicates,
+			IndexMode:           indexMode,
+			PrebuiltIndex:       prebuiltIndex,
+			AllowStaleIndex:     allowStaleIndex,
+			VerifyIndexChecksum: verifyIndexChecksum,
+			SortedInputs:        sortedInputs,
+			MaxMemory:           maxMemory,
+			PreserveOrder:       preserveOrder,
+			Resume:              resumeFrom,
+			OutputDebugMode:     debugMode,
+			Logger:              logger,
+			ContinueOnErr:       continueOnError,
+			MaxErrors:           maxErrorsBudget,
+			MaxErrorRate:        maxErrorRate,
+			Rejects:             rejectsWriter(rejects),
+			CollectMetrics:      metricsAddr != "",
 			LeftQueryOptions: smalljoin.QueryOptions{
-				JoinColumn:     lJoinColumn,
-				Separator:      lSeparator,
-				JsonSubquery:   lJsonSubquery,
-				AttemptToClean: attemptToClean,
+				JoinColumns:     lJoinColumns,
+				JoinColumnNames: lJoinColumnNames,
+				Header:          lHeader,
+				HeaderGiven:     flagGiven(flag.CommandLine, "left-header"),
+				Separator:       lSeparator,
+				JsonSubqueries:  lJsonSubqueries,
+				AttemptToClean:  attemptToClean,
+				Dialect:         lDialect,
+				Format:          parseFormat("left", lFormatStr),
+				JSONArrayPath:   lJSONArrayPath,
 			},
 			RightQueryOptions: smalljoin.QueryOptions{
-				JoinColumn:     rJoinColumn,
-				Separator:      rSeparator,
-				JsonSubquery:   rJsonSubquery,
-				AttemptToClean: attemptToClean,
+				JoinColumns:     rJoinColumns,
+				JoinColumnNames: rJoinColumnNames,
+				Header:          rHeader,
+				HeaderGiven:     flagGiven(flag.CommandLine, "right-header"),
+				Separator:       rSeparator,
+				JsonSubqueries:  rJsonSubqueries,
+				AttemptToClean:  attemptToClean,
+				Dialect:         rDialect,
+				Format:          parseFormat("right", rFormatStr),
+				JSONArrayPath:   rJSONArrayPath,
 			},
+
+			BloomFalsePositiveRate: bloomFalsePositiveRate,
+			Checkpoint:             checkpointPath,
+			CheckpointInterval:     checkpointInterval,
 		})
 
-	err := joiner.Run()
+	var metrics *metricsServer
+	if metricsAddr != "" {
+		metrics, err = startMetricsServer(metricsAddr, joiner, logger)
+		if err != nil {
+			log.Fatalf("failed to serve metrics on %s: %v", metricsAddr, err)
+		}
+	}
+
+	var progressReporter *progressReporter
+	if progress {
+		progressReporter = startProgress(joiner, progressInterval, inputSize, logger, stderr)
+	}
+	err = joiner.RunContext(ctx)
+	if progressReporter != nil {
+		progressReporter.finish()
+	}
+	if metrics != nil {
+		metrics.close()
+	}
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if rejects != nil {
+		if flushErr := rejects.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	if statsFormat != "" {
+		if statsErr := writeStats(statsFormat, statsFile, joiner.Stats()); statsErr != nil {
+			logger.Error("failed to write stats", "error", statsErr.Error())
+		}
+	}
+	if ctx.Err() != nil {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logJoinError(logger, err)
+		}
+		stats := joiner.Stats()
+		logger.Warn("interrupted", "lines_read", stats.LinesRead, "matched", stats.Matched,
+			"errored", stats.Errored, "last_offset", stats.LastOffset)
+		os.Exit(130)
+	}
+	var budgetErr *smalljoin.ErrorBudgetExceeded
+	if errors.As(err, &budgetErr) {
+		logJoinError(logger, err)
+		os.Exit(exitErrorBudgetExceeded)
+	}
+	if err != nil {
+		logJoinError(logger, err)
+		os.Exit(1)
+	}
+}
+
+func newLogger(w io.Writer, logFormatStr string, debugMode bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debugMode {
+		level = slog.LevelDebug
+	}
+	switch strings.ToLower(logFormatStr) {
+	case "text":
+		return smalljoin.NewLogger(w, smalljoin.LogFormatText, level)
+	case "json":
+		return smalljoin.NewLogger(w, smalljoin.LogFormatJSON, level)
+	}
+	log.Fatalf("not a valid log format %q, options are: 'text', 'json'\n", logFormatStr)
+	return nil
+}
+
+func logJoinError(logger *slog.Logger, err error) {
+	attrs := []any{"category", smalljoin.ErrorCategory(err), "error", err.Error()}
+	var rowErr *smalljoin.RowError
+	if errors.As(err, &rowErr) {
+		attrs = append(attrs, "line", rowErr.Line, "offset", rowErr.Offset)
+	}
+	logger.Error("fatal error while trying to join", attrs...)
+}
+
+// the exit status when too many rows couldn't be joined, to tell
+// it apart from the join failing outright
+const exitErrorBudgetExceeded = 3
+
+// a nil *bufio.Writer has to be a nil io.Writer, for the joiner to know there isn't one
+func rejectsWriter(w *bufio.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	return w
+}
+
+// opens the reject file, adding to it rather than starting again when resuming
+func openRejects(path string, resuming bool) (*os.File, error) {
+	if resuming {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	return os.Create(path)
+}
+
+// buffers the output, rather than writing it out a row at a time
+type bufferedOutput struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (b bufferedOutput) Close() error {
+	return b.Flush()
+}
+
+// makes sure the output is on disk, before a checkpoint says it is
+func (b bufferedOutput) Sync() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return b.file.Sync()
+}
+
+// opens the output file, cutting it back to where the checkpoint
+// got to when resuming, so no results are repeated
+func openOutput(path string, resumeFrom *smalljoin.Checkpoint) (*os.File, error) {
+	if resumeFrom == nil {
+		return os.Create(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.Stat()
+	if err == nil && s.Size() < resumeFrom.OutputOffset {
+		err = fmt.Errorf("the output is only %d bytes, but the checkpoint is at %d bytes", s.Size(), resumeFrom.OutputOffset)
+	}
+	if err == nil {
+		err = f.Truncate(resumeFrom.OutputOffset)
+	}
+	if err == nil {
+		_, err = f.Seek(resumeFrom.OutputOffset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// a flag which can be specified several times
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringListFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// parses a comma separated list of zero-based column numbers, eg "2,5".
+// If any of them aren't numbers, they're all returned as column names
+// to be looked up in the input's header
+func parseColumnList(s string) ([]int, []string) {
+	var cols []int
+	var names []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		names = append(names, c)
+		col, err := strconv.Atoi(c)
+		if err == nil {
+			cols = append(cols, col)
+		}
+	}
+	if len(cols) == len(names) {
+		return cols, nil
+	}
+	return nil, names
+}
+
+func parseDuplicates(duplicatesStr string) smalljoin.DuplicateKeyPolicy {
+	switch strings.ToLower(duplicatesStr) {
+	case "all":
+		return smalljoin.DuplicateKeysAll
+	case "first":
+		return smalljoin.DuplicateKeysFirst
+	case "last":
+		return smalljoin.DuplicateKeysLast
+	case "error":
+		return smalljoin.DuplicateKeysError
+	}
+	log.Fatalf("not a valid duplicate handling option %q, options are: 'all', 'first', 'last', 'error'\n", duplicatesStr)
+	return 0
+}
+
+// whether the flag was given on the command line, rather than left as its default
+func flagGiven(flags *flag.FlagSet, name string) bool {
+	given := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+func parseFormat(side string, formatStr string) smalljoin.InputFormat {
+	switch strings.ToLower(formatStr) {
+	case "delimited":
+		return smalljoin.FormatDelimited
+	case "ndjson":
+		return smalljoin.FormatNDJSON
+	case "json":
+		return smalljoin.FormatJSON
+	}
+	log.Fatalf("not a valid %s format %q, options are: 'delimited', 'ndjson', 'json'\n", side, formatStr)
+	return 0
+}
+
+// parses a size such as 512MB, 2G or 1024, returning the number of bytes
+func parseByteSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+		{"B", 1},
+	}
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper = strings.TrimSuffix(upper, u.suffix)
+			multiplier = u.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
 	if err != nil {
-		log.Fatalf("Fatal error while trying to join: %s", err)
+		return 0, err
 	}
+	return int64(n * float64(multiplier)), nil
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/davidporter-id-au/small-join/smalljoin"
+)
+
+// serves the join's metrics on /metrics, in the Prometheus text format,
+// and Go's profiles on /debug/pprof/, for as long as the join is running
+type metricsServer struct {
+	server *http.Server
+	done   chan struct{}
+}
+
+// listens on addr straight away, so that a bad address fails before the join starts
+func startMetricsServer(addr string, joiner smalljoin.Joiner, logger *slog.Logger) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := joiner.WriteMetrics(w); err != nil {
+			logger.Debug("failed to serve metrics", "error", err.Error())
+		}
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	m := &metricsServer{
+		server: &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(m.done)
+		if err := m.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server failed", "error", err.Error())
+		}
+	}()
+	logger.Debug("serving metrics", "addr", listener.Addr().String())
+	return m, nil
+}
+
+// stops the server, giving any scrape in flight a moment to finish
+func (m *metricsServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m.server.Shutdown(ctx)
+	<-m.done
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidporter-id-au/small-join/smalljoin"
+)
+
+// periodically reports how far through the incoming stream the join has
+// got, on stderr. On a terminal this is a single line which is rewritten
+// each time, otherwise each report is logged.
+type progressReporter struct {
+	joiner   smalljoin.Joiner
+	interval time.Duration
+	// the size of the incoming stream, if it's known
+	size     int64
+	terminal bool
+	logger   *slog.Logger
+	status   *statusWriter
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startProgress(joiner smalljoin.Joiner, interval time.Duration, size int64, logger *slog.Logger, status *statusWriter) *progressReporter {
+	p := &progressReporter{
+		joiner:   joiner,
+		interval: interval,
+		size:     size,
+		terminal: smalljoin.IsTerminal(status),
+		logger:   logger,
+		status:   status,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressReporter) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	start := time.Now()
+	first := p.joiner.Stats()
+	prev, prevTime := first, start
+	for {
+		select {
+		case <-p.stop:
+			// clear the line, so it isn't left behind
+			p.status.setStatus("")
+			return
+		case now := <-ticker.C:
+			stats := p.joiner.Stats()
+			p.report(stats, first, start, prev, prevTime, now)
+			prev, prevTime = stats, now
+		}
+	}
+}
+
+// the figures in a progress report
+type progressFigures struct {
+	rowsPerSec float64
+	matchRate  float64
+	// only if the size of the incoming stream is known
+	percent float64
+	eta     time.Duration
+	hasETA  bool
+}
+
+// the rows per second are since the last report, so they follow changes in the
+// rate, but the ETA is based on the rate since the start so it doesn't jump around
+func (p *progressReporter) figures(stats, first smalljoin.Stats, start time.Time, prev smalljoin.Stats, prevTime time.Time, now time.Time) progressFigures {
+	var f progressFigures
+	if elapsed := now.Sub(prevTime).Seconds(); elapsed > 0 {
+		f.rowsPerSec = float64(stats.LinesRead-prev.LinesRead) / elapsed
+	}
+	if stats.LinesRead > 0 {
+		f.matchRate = float64(stats.Matched) / float64(stats.LinesRead)
+	}
+	if p.size > 0 {
+		f.percent = float64(stats.LastOffset) / float64(p.size)
+		bytesPerSec := float64(stats.LastOffset-first.LastOffset) / now.Sub(start).Seconds()
+		if bytesPerSec > 0 && stats.LastOffset <= p.size {
+			f.eta = time.Duration(float64(p.size-stats.LastOffset) / bytesPerSec * float64(time.Second)).Round(time.Second)
+			f.hasETA = true
+		}
+	}
+	return f
+}
+
+func (p *progressReporter) report(stats, first smalljoin.Stats, start time.Time, prev smalljoin.Stats, prevTime time.Time, now time.Time) {
+	f := p.figures(stats, first, start, prev, prevTime, now)
+	if !p.terminal {
+		attrs := []any{"rows_read", stats.LinesRead, "rows_per_second", int64(f.rowsPerSec),
+			"bytes_processed", stats.LastOffset, "match_rate", roundTo(f.matchRate, 4)}
+		if p.size > 0 {
+			attrs = append(attrs, "percent", roundTo(f.percent*100, 1))
+		}
+		if f.hasETA {
+			attrs = append(attrs, "eta", f.eta.String())
+		}
+		p.logger.Info("progress", attrs...)
+		return
+	}
+
+	parts := []string{
+		fmt.Sprintf("%s rows (%s rows/s)", humanCount(float64(stats.LinesRead)), humanCount(f.rowsPerSec)),
+		humanBytes(stats.LastOffset),
+		fmt.Sprintf("%.1f%% matched", f.matchRate*100),
+	}
+	if p.size > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f%% done", f.percent*100))
+	}
+	if f.hasETA {
+		parts = append(parts, "ETA "+f.eta.String())
+	}
+	p.status.setStatus(strings.Join(parts, ", "))
+}
+
+// stderr, which is shared by the logs and the progress line. On a terminal,
+// the progress line is cleared before anything else is written, and then
+// drawn again after it, so that logs don't end up on the end of it.
+type statusWriter struct {
+	lock   sync.Mutex
+	w      io.Writer
+	status string
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.status != "" {
+		io.WriteString(s.w, "\r\033[K")
+	}
+	n, err := s.w.Write(b)
+	if s.status != "" {
+		io.WriteString(s.w, s.status)
+	}
+	return n, err
+}
+
+// so that it can be told whether it's a terminal, just as stderr can
+func (s *statusWriter) Stat() (os.FileInfo, error) {
+	f, ok := s.w.(*os.File)
+	if !ok {
+		return nil, fmt.Errorf("not a file")
+	}
+	return f.Stat()
+}
+
+// replaces the progress line, or clears it if status is empty
+func (s *statusWriter) setStatus(status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if status == "" && s.status == "" {
+		return
+	}
+	s.status = status
+	io.WriteString(s.w, "\r\033[K"+status)
+}
+
+// stops reporting, once the join is done
+func (p *progressReporter) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+// the size of the incoming stream, if it's a file
+func inputFileSize(input *os.File) int64 {
+	s, err := input.Stat()
+	if err != nil || !s.Mode().IsRegular() {
+		return 0
+	}
+	return s.Size()
+}
+
+func humanCount(n float64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fG", n/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", n/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fk", n/1e3)
+	}
+	return fmt.Sprintf("%.0f", n)
+}
+
+func humanBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow10(places)
+	return math.Round(v*p) / p
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/davidporter-id-au/small-join/smalljoin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressFigures(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		size      int64
+		first     smalljoin.Stats
+		prev      smalljoin.Stats
+		stats     smalljoin.Stats
+		elapsed   time.Duration
+		sincePrev time.Duration
+		expected  progressFigures
+	}{
+		"an unknown size": {
+			stats:     smalljoin.Stats{LinesRead: 400, Matched: 100, LastOffset: 4000},
+			prev:      smalljoin.Stats{LinesRead: 200},
+			elapsed:   4 * time.Second,
+			sincePrev: 2 * time.Second,
+			expected:  progressFigures{rowsPerSec: 100, matchRate: 0.25},
+		},
+		"a known size": {
+			size:      10000,
+			stats:     smalljoin.Stats{LinesRead: 400, Matched: 400, LastOffset: 4000},
+			prev:      smalljoin.Stats{LinesRead: 300},
+			elapsed:   4 * time.Second,
+			sincePrev: time.Second,
+			expected:  progressFigures{rowsPerSec: 100, matchRate: 1, percent: 0.4, eta: 6 * time.Second, hasETA: true},
+		},
+		"resumed part way through": {
+			// the rate is only of what's been joined since starting
+			size:      10000,
+			first:     smalljoin.Stats{LastOffset: 8000},
+			stats:     smalljoin.Stats{LastOffset: 9000},
+			elapsed:   10 * time.Second,
+			sincePrev: 10 * time.Second,
+			expected:  progressFigures{percent: 0.9, eta: 10 * time.Second, hasETA: true},
+		},
+		"nothing processed yet": {
+			size:      10000,
+			elapsed:   time.Second,
+			sincePrev: time.Second,
+			expected:  progressFigures{},
+		},
+		"past the given size": {
+			size:      1000,
+			stats:     smalljoin.Stats{LastOffset: 2000},
+			elapsed:   time.Second,
+			sincePrev: time.Second,
+			expected:  progressFigures{percent: 2},
+		},
+	}
+	for name, test := range tests {
+		p := &progressReporter{size: test.size}
+		now := start.Add(test.elapsed)
+		f := p.figures(test.stats, test.first, start, test.prev, now.Add(-test.sincePrev), now)
+		assert.Equal(t, test.expected, f, name)
+	}
+}
+
+func TestProgressReport(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(2 * time.Second)
+	stats := smalljoin.Stats{LinesRead: 2500, Matched: 1000, LastOffset: 3 << 20}
+
+	var logs bytes.Buffer
+	p := &progressReporter{size: 6 << 20, logger: slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))}
+	p.report(stats, smalljoin.Stats{}, start, smalljoin.Stats{}, start, now)
+	assert.Equal(t, "level=INFO msg=progress rows_read=2500 rows_per_second=1250 bytes_processed=3145728 match_rate=0.4 percent=50 eta=2s\n", logs.String())
+
+	var terminal bytes.Buffer
+	p = &progressReporter{size: 6 << 20, terminal: true, status: &statusWriter{w: &terminal}}
+	p.report(stats, smalljoin.Stats{}, start, smalljoin.Stats{}, start, now)
+	assert.Equal(t, "\r\033[K2.5k rows (1.2k rows/s), 3.0MB, 40.0% matched, 50.0% done, ETA 2s", terminal.String())
+}
+
+func TestStatusWriter(t *testing.T) {
+	var out bytes.Buffer
+	s := &statusWriter{w: &out}
+	s.Write([]byte("before\n"))
+	s.setStatus("10 rows")
+	s.Write([]byte("a log\n"))
+	s.setStatus("")
+	s.setStatus("")
+	// the progress line is cleared for the log, and drawn again after it
+	assert.Equal(t, "before\n\r\033[K10 rows\r\033[Ka log\n10 rows\r\033[K", out.String())
+}
+
+func TestHumanCount(t *testing.T) {
+	tests := map[float64]string{
+		0:          "0",
+		999:        "999",
+		1000:       "1.0k",
+		1250:       "1.2k",
+		2500000:    "2.5M",
+		3000000000: "3.0G",
+	}
+	for n, expected := range tests {
+		assert.Equal(t, expected, humanCount(n), n)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:          "0B",
+		1023:       "1023B",
+		1024:       "1.0KB",
+		1536:       "1.5KB",
+		5 << 20:    "5.0MB",
+		3 << 30:    "3.0GB",
+		2 << 40:    "2.0TB",
+		2048 << 40: "2048.0TB",
+	}
+	for n, expected := range tests {
+		assert.Equal(t, expected, humanBytes(n), n)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]struct {
+		expected int64
+		err      bool
+	}{
+		"":     {expected: 0},
+		"512":  {expected: 512},
+		"20GB": {expected: 20 << 30},
+		"1.5m": {expected: 3 << 19},
+		" 2K ": {expected: 2048},
+		"10B":  {expected: 10},
+		"lots": {err: true},
+		"GB":   {err: true},
+	}
+	for s, test := range tests {
+		n, err := parseByteSize(s)
+		if test.err {
+			assert.Error(t, err, s)
+			continue
+		}
+		assert.NoError(t, err, s)
+		assert.Equal(t, test.expected, n, s)
+	}
+}
@@ -0,0 +1,85 @@
+package smalljoin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// a bloom filter of the index's keys, allowing for most lookups of keys which
+// aren't in the index to be rejected without a lookup. The fields are exported
+// only so that it can be persisted with a prebuilt index.
+type bloomFilter struct {
+	Bits      []uint64
+	NumBits   uint64
+	NumHashes uint32
+}
+
+// checks a false positive rate, where 0 means there's no filter. Anything
+// outside of (0,1) can't size a filter: 1 or more would give it no bits, and
+// a negative rate would overflow its size.
+func validateBloomFalsePositiveRate(rate float64) error {
+	if !(rate >= 0 && rate < 1) {
+		return fmt.Errorf("not a valid bloom filter false positive rate %v, it needs to be between 0 and 1", rate)
+	}
+	return nil
+}
+
+// sizes the filter for n keys with the given rate of false positives
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	if m < 64 {
+		m = 64
+	}
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	numBits := uint64(m)
+	return &bloomFilter{
+		Bits:      make([]uint64, (numBits+63)/64),
+		NumBits:   numBits,
+		NumHashes: uint32(k),
+	}
+}
+
+func newBloomFilterForIndex(index rightIndex, falsePositiveRate float64) *bloomFilter {
+	b := newBloomFilter(len(index), falsePositiveRate)
+	for k := range index {
+		b.add(k)
+	}
+	return b
+}
+
+// uses double hashing to derive each of the filter's hashes
+// from the two halves of a single 64 bit hash
+func (b *bloomFilter) hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := b.hashes(key)
+	for i := uint64(0); i < uint64(b.NumHashes); i++ {
+		bit := (h1 + i*h2) % b.NumBits
+		b.Bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// false means the key is definitely not in the index,
+// true means it probably is
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := b.hashes(key)
+	for i := uint64(0); i < uint64(b.NumHashes); i++ {
+		bit := (h1 + i*h2) % b.NumBits
+		if b.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package smalljoin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	index := rightIndex{}
+	for i := 0; i < 10000; i++ {
+		index[fmt.Sprintf("key-%d", i)] = nil
+	}
+	b := newBloomFilterForIndex(index, 0.01)
+
+	for k := range index {
+		assert.True(t, b.mayContain(k), "bloom filters should never have false negatives")
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if b.mayContain(fmt.Sprintf("missing-%d", i)) {
+			falsePositives++
+		}
+	}
+	// allowing for some slack over the 1% requested
+	assert.Less(t, falsePositives, 200)
+}
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	tests := map[string]struct {
+		rate  float64
+		valid bool
+	}{
+		"no filter":     {rate: 0, valid: true},
+		"a normal rate": {rate: 0.01, valid: true},
+		"negative":      {rate: -0.01},
+		"one":           {rate: 1},
+		"more than one": {rate: 1.5},
+		"NaN":           {rate: math.NaN()},
+	}
+	for name, test := range tests {
+		j := New(ioutil.NopCloser(strings.NewReader("")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+			Jointype:               JoinTypeInner,
+			Concurrency:            1,
+			IndexFile:              "internal/testdata/index_4",
+			BloomFalsePositiveRate: test.rate,
+			RightQueryOptions:      QueryOptions{Separator: ","},
+			LeftQueryOptions:       QueryOptions{Separator: ","},
+		})
+		runErr := j.Run()
+		buildErr := BuildIndexFile("internal/testdata/index_4", filepath.Join(t.TempDir(), "index.idx"), QueryOptions{Separator: ","}, DuplicateKeysAll, test.rate)
+		if test.valid {
+			assert.NoError(t, runErr, name)
+			assert.NoError(t, buildErr, name)
+			continue
+		}
+		assert.EqualError(t, runErr, fmt.Sprintf("not a valid bloom filter false positive rate %v, it needs to be between 0 and 1", test.rate), name)
+		assert.Error(t, buildErr, name)
+	}
+}
@@ -0,0 +1,116 @@
+package smalljoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const defaultCheckpointInterval = 10 * time.Second
+
+// Checkpoint records how far through the incoming stream a join has got. Every
+// row up to InputOffset has been joined, and its results are in the first
+// OutputOffset bytes of the output, and nothing after them is.
+type Checkpoint struct {
+	InputOffset  int64 `json:"inputOffset"`
+	OutputOffset int64 `json:"outputOffset"`
+	// the line number of the last row which was joined, counting the header
+	Line int64 `json:"line"`
+}
+
+// ReadCheckpoint reads a checkpoint written during an earlier join
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var c Checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %q: %w", path, err)
+	}
+	return &c, nil
+}
+
+// writes the checkpoint to a temporary file first, and moves it into
+// place, so that a crash never leaves a half written checkpoint behind
+func (c Checkpoint) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// the output has to actually be written out before a checkpoint can say it is
+func syncOutput(w interface{}) error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// keeps track of the position of the writer, in both the incoming stream
+// and the output, as the blocks are written out in order
+type checkpointer struct {
+	path     string
+	interval time.Duration
+	current  Checkpoint
+	lastSave time.Time
+	// set once a block has a row which fails the join, as
+	// that row has to be joined again when it's resumed
+	halted bool
+}
+
+// moves the checkpoint on past a block, once it's been written out
+func (c *checkpointer) commit(b blockResult) {
+	if c.halted {
+		return
+	}
+	c.current.InputOffset = b.end
+	c.current.OutputOffset += int64(len(b.output))
+	if b.lastLine > 0 {
+		c.current.Line = b.lastLine
+	}
+}
+
+// saves the checkpoint, if it's been long enough since the last one
+func (c *checkpointer) maybeSave(output interface{}) error {
+	if time.Since(c.lastSave) < c.interval {
+		return nil
+	}
+	return c.save(output)
+}
+
+func (c *checkpointer) save(output interface{}) error {
+	if err := syncOutput(output); err != nil {
+		return fmt.Errorf("failed to flush output for checkpoint: %w", err)
+	}
+	if err := c.current.save(c.path); err != nil {
+		return err
+	}
+	c.lastSave = time.Now()
+	return nil
+}
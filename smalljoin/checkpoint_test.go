@@ -0,0 +1,112 @@
+package smalljoin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointAndResume(t *testing.T) {
+	dir := t.TempDir()
+	leftFile := filepath.Join(dir, "left")
+	input := "id\na\nq\nb\nq\nz\nq\ny\n"
+	assert.NoError(t, os.WriteFile(leftFile, []byte(input), 0644))
+
+	run := func(resume *Checkpoint) (string, Checkpoint) {
+		f, err := os.Open(leftFile)
+		assert.NoError(t, err)
+		out := bytes.NewBuffer(nil)
+		checkpointFile := filepath.Join(dir, "checkpoint")
+		j := New(f, createNoopWriteCloser(out), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+			Jointype:           JoinTypeInner,
+			IndexFile:          "internal/testdata/index_4",
+			IncomingBufferSize: 2,
+			Checkpoint:         checkpointFile,
+			Resume:             resume,
+			LeftQueryOptions: QueryOptions{
+				JoinColumn: -1,
+				Header:     true,
+			},
+			RightQueryOptions: QueryOptions{
+				JoinColumn: -1,
+			},
+		})
+		assert.NoError(t, j.Run())
+		c, err := ReadCheckpoint(checkpointFile)
+		assert.NoError(t, err)
+		return out.String(), *c
+	}
+
+	full, c := run(nil)
+	assert.Equal(t, Checkpoint{InputOffset: int64(len(input)), OutputOffset: int64(len(full)), Line: 8}, c)
+
+	// carry on from after the 'b' row, as if the join had stopped there
+	lines := strings.SplitAfter(full, "\n")
+	resumeFrom := &Checkpoint{
+		InputOffset:  int64(strings.Index(input, "q\nz")),
+		OutputOffset: int64(len(lines[0] + lines[1])),
+		Line:         4,
+	}
+	rest, c := run(resumeFrom)
+	assert.Equal(t, full, lines[0]+lines[1]+rest)
+	assert.Equal(t, Checkpoint{InputOffset: int64(len(input)), OutputOffset: int64(len(full)), Line: 8}, c)
+}
+
+func TestCheckpointRequiresOrderedJoin(t *testing.T) {
+	j := New(nil, nil, nil, Options{
+		Jointype:   JoinTypeFull,
+		IndexFile:  "internal/testdata/index_4",
+		Checkpoint: filepath.Join(t.TempDir(), "checkpoint"),
+	})
+	assert.Error(t, j.Run())
+}
+
+func TestCheckpointAfterFailure(t *testing.T) {
+	dir := t.TempDir()
+	leftFile := filepath.Join(dir, "left")
+	checkpointFile := filepath.Join(dir, "checkpoint")
+	rows := make([]string, 3000)
+	for i := range rows {
+		rows[i] = `{"id":"a"}` + "\n"
+	}
+	// the same length as the other rows, so the offsets line up once it's fixed
+	rows[1500] = "not json!!\n"
+	badOffset := int64(1500 * len(rows[0]))
+
+	run := func(input string, resume *Checkpoint, out *bytes.Buffer) error {
+		assert.NoError(t, os.WriteFile(leftFile, []byte(input), 0644))
+		f, err := os.Open(leftFile)
+		assert.NoError(t, err)
+		j := New(f, createNoopWriteCloser(out), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+			Jointype:           JoinTypeInner,
+			IndexFile:          "internal/testdata/index_4",
+			Concurrency:        4,
+			Checkpoint:         checkpointFile,
+			CheckpointInterval: time.Nanosecond,
+			Resume:             resume,
+			LeftQueryOptions:   QueryOptions{JoinColumn: -1, JsonSubquery: "id"},
+			RightQueryOptions:  QueryOptions{JoinColumn: -1},
+		})
+		return j.Run()
+	}
+
+	out := bytes.NewBuffer(nil)
+	assert.Error(t, run(strings.Join(rows, ""), nil, out))
+	c, err := ReadCheckpoint(checkpointFile)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, c.InputOffset, badOffset)
+
+	// fixing the row and resuming picks up from before it
+	rows[1500] = `{"id":"a"}` + "\n"
+	fixed := strings.Join(rows, "")
+	full := bytes.NewBuffer(nil)
+	assert.NoError(t, run(fixed, nil, full))
+	resumed := bytes.NewBuffer(out.Bytes()[:c.OutputOffset])
+	assert.NoError(t, run(fixed, c, resumed))
+	assert.Equal(t, full.String(), resumed.String())
+}
@@ -1,17 +1,32 @@
 package smalljoin
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"strings"
+	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Joiner interface {
 	Run() error
+	// RunContext runs the join until the incoming stream is finished or the
+	// context is cancelled. On cancellation, it stops reading the stream,
+	// finishes joining and writing out the blocks which are already being
+	// joined, and returns the context's error.
+	RunContext(ctx context.Context) error
+	// Stats gives how far the join has got, and can be called while it's running
+	Stats() Stats
+	// WriteMetrics writes out metrics about the join in the Prometheus
+	// text format, and can be called while it's running. The latency
+	// histograms are only included with CollectMetrics.
+	WriteMetrics(w io.Writer) error
 }
 
 type streams struct {
@@ -20,29 +35,91 @@ type streams struct {
 	err    io.WriteCloser
 }
 
+// a block of lines from the incoming stream, numbered
+// in the order in which they were read
+type block struct {
+	seq     int
+	records []record
+	// the byte offset of the end of the block in the incoming
+	// stream, and the line number of its last row
+	end      int64
+	lastLine int64
+}
+
+// the output of joining a block
+type blockResult struct {
+	seq      int
+	output   []byte
+	end      int64
+	lastLine int64
+	// whether any of its rows couldn't be joined
+	errored bool
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 type joiner struct {
-	streams     streams
-	errors      chan error
-	incoming    chan []string
-	readWG      sync.WaitGroup
-	writeWG     sync.WaitGroup
-	options     Options
-	critLock    sync.RWMutex
-	moreContent bool
-	hashIndex   rightIndex
+	streams    streams
+	errors     chan error
+	incoming   chan block
+	results    chan blockResult
+	window     chan struct{}
+	writeWG    sync.WaitGroup
+	options    Options
+	hashIndex  rightIndex
+	indexFile  io.ReaderAt
+	bloom      *bloomFilter
+	bloomStats bloomStats
+	stats      joinStats
+	metrics    joinMetrics
+	logger     *slog.Logger
+	checkpoint *checkpointer
+
+	// where the rows start in the incoming stream, after the header
+	startLine   int64
+	startOffset int64
+
+	// stops the join early, once it's failed
+	cancel   context.CancelFunc
+	failOnce sync.Once
+	failLock sync.Mutex
+	failure  error
 }
 
-func New(inputstream io.ReadCloser, outputstream io.WriteCloser, errStream io.WriteCloser, o Options) Joiner {
-	incomingBuffer := make(chan []string, o.IncomingBufferSize)
-	errChan := make(chan error)
-	var wg sync.WaitGroup
+type bloomStats struct {
+	checks         int64
+	rejected       int64
+	falsePositives int64
+}
 
+func New(inputstream io.ReadCloser, outputstream io.WriteCloser, errStream io.WriteCloser, o Options) Joiner {
 	if o.Concurrency == 0 {
 		o.Concurrency = defaultConcurrency
 	}
 	if o.IncomingBufferSize == 0 {
 		o.IncomingBufferSize = defaultInputByteLen
 	}
+	if o.Checkpoint != "" {
+		o.PreserveOrder = true
+		if o.CheckpointInterval == 0 {
+			o.CheckpointInterval = defaultCheckpointInterval
+		}
+	}
+	incomingBuffer := make(chan block, o.IncomingBufferSize)
+	errChan := make(chan error)
+
+	logger := o.Logger
+	if logger == nil {
+		logger = defaultLogger(errStream, o.OutputDebugMode)
+	}
+
+	var window chan struct{}
+	if o.PreserveOrder {
+		window = make(chan struct{}, o.Concurrency*reorderWindowPerWorker)
+	}
 
 	return &joiner{
 		streams: streams{
@@ -50,135 +127,429 @@ func New(inputstream io.ReadCloser, outputstream io.WriteCloser, errStream io.Wr
 			output: outputstream,
 			err:    errStream,
 		},
-		readWG:      wg,
-		errors:      errChan,
-		incoming:    incomingBuffer,
-		options:     o,
-		moreContent: true,
+		errors:   errChan,
+		incoming: incomingBuffer,
+		results:  make(chan blockResult, o.Concurrency),
+		window:   window,
+		options:  o,
+		logger:   logger,
+		stats:    newJoinStats(),
+		metrics:  newJoinMetrics(o.CollectMetrics),
 	}
 }
 
-// for now, this just reads the right join file entirely into memory and builds an index
-// in memory. This isn't going to work for large index files, so a future
-// iteration of this will probably build an index which contains file-offsets.
-// but for now this is the MVP
-func createIndexMap(right string, queryOptions QueryOptions) (rightIndex, error) {
-	d, err := ioutil.ReadFile(right)
-	if err != nil {
-		return nil, err
+func (j *joiner) Run() error {
+	return j.RunContext(context.Background())
+}
+
+func (j *joiner) RunContext(ctx context.Context) error {
+	// these would otherwise only be found by the workers, which can't fail
+	// the join up front
+	if j.options.Jointype < JoinTypeInner || j.options.Jointype > JoinTypeLeftIsNull {
+		return fmt.Errorf("not a valid join type %d", j.options.Jointype)
+	}
+	if j.options.IndexFile == "" && j.options.PrebuiltIndex == "" && j.options.RightExecStr == "" {
+		return fmt.Errorf("the right side of the join is required: an index file, a prebuilt index or a command to run")
+	}
+	if requiresIndexFile(j.options.Jointype) && j.options.IndexFile == "" && j.options.PrebuiltIndex == "" {
+		return fmt.Errorf("right, full and left-is-null joins require an index file to be specified")
+	}
+	if err := validateBloomFalsePositiveRate(j.options.BloomFalsePositiveRate); err != nil {
+		return err
+	}
+	if err := j.options.validateErrorBudget(); err != nil {
+		return err
+	}
+	if err := j.options.LeftQueryOptions.validateFormat("left"); err != nil {
+		return err
+	}
+	if err := j.options.RightQueryOptions.validateFormat("right"); err != nil {
+		return err
+	}
+	if err := j.options.LeftQueryOptions.Dialect.validate(j.options.LeftQueryOptions.Separator); err != nil {
+		return fmt.Errorf("invalid left CSV dialect: %w", err)
+	}
+	if err := j.options.RightQueryOptions.Dialect.validate(j.options.RightQueryOptions.Separator); err != nil {
+		return fmt.Errorf("invalid right CSV dialect: %w", err)
 	}
-	split := strings.Split(string(d), "\n")
-	out := rightIndex{}
-	for _, line := range split {
-		k, err := attemptSplitAndSelectCol(line, queryOptions)
+	if j.options.Checkpoint != "" || j.options.Resume != nil {
+		// the unmatched rows of the index file depend on the whole of the
+		// incoming stream, and the merge join's state isn't recorded
+		if requiresIndexFile(j.options.Jointype) {
+			return fmt.Errorf("right, full and left-is-null joins can't be checkpointed or resumed")
+		}
+		if j.options.SortedInputs {
+			return fmt.Errorf("joins of sorted inputs can't be checkpointed or resumed")
+		}
+		if j.options.LeftQueryOptions.Format == FormatJSON {
+			return fmt.Errorf("JSON which isn't split up by lines can't be checkpointed or resumed, as there's nowhere to resume reading it from")
+		}
+	}
+
+	if j.options.RightQueryOptions.sniffed() && j.options.IndexFile != "" && j.options.PrebuiltIndex == "" {
+		var err error
+		j.options.RightQueryOptions, err = sniffIndexFile(j.options.IndexFile, j.options.RightQueryOptions, j.logger)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to detect the format of the index file: %w", err)
 		}
-		out[k] = indexEntry{data: line}
 	}
-	return out, nil
-}
 
-func (j *joiner) Run() error {
-	if j.options.IndexFile != "" {
-		i, err := createIndexMap(j.options.IndexFile, j.options.RightQueryOptions)
+	input := j.streams.input
+	var r *bufio.Reader
+	if j.options.LeftQueryOptions.sniffed() {
+		// peeked at, so the rows are still there to be joined
+		r = bufio.NewReaderSize(j.streams.input, sniffBytes)
+		var err error
+		j.options.LeftQueryOptions, err = sniffStream(r, j.options.LeftQueryOptions, j.logger)
+		if err != nil {
+			return withCategory(ErrorCategoryInput, fmt.Errorf("failed to detect the format of the incoming stream: %w", err))
+		}
+		input = readCloser{Reader: r, Closer: j.streams.input}
+	}
+	// whether there's a header may have only just been detected
+	if len(j.options.LeftQueryOptions.JoinColumnNames) > 0 && !j.options.LeftQueryOptions.Header {
+		return fmt.Errorf("left join columns can only be given by name when the input has a header")
+	}
+	if len(j.options.RightQueryOptions.JoinColumnNames) > 0 && !j.options.RightQueryOptions.Header {
+		return fmt.Errorf("right join columns can only be given by name when the index file has a header")
+	}
+	if j.options.LeftQueryOptions.Header {
+		// the header needs to be consumed before any of
+		// the workers start attempting to join on the rows
+		if r == nil {
+			r = bufio.NewReader(j.streams.input)
+		}
+		headerRow, headerLen, err := readHeaderLine(r)
+		if err != nil {
+			return fmt.Errorf("failed to read header of incoming stream: %w", err)
+		}
+		j.options.LeftQueryOptions, err = j.options.LeftQueryOptions.withHeader(headerRow)
 		if err != nil {
-			return fmt.Errorf("failed to parse index: %w", err)
+			return fmt.Errorf("failed to parse header of incoming stream: %w", err)
+		}
+		input = readCloser{Reader: r, Closer: j.streams.input}
+		j.startLine = 1
+		j.startOffset = int64(headerLen)
+	}
+	if resume := j.options.Resume; resume != nil {
+		// skip the rows which were already joined
+		seeker, ok := j.streams.input.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("resuming a join requires the incoming stream to be a file")
+		}
+		if _, err := seeker.Seek(resume.InputOffset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to resume incoming stream from byte offset %d: %w", resume.InputOffset, err)
+		}
+		input = j.streams.input
+		j.startLine = resume.Line
+		j.startOffset = resume.InputOffset
+	}
+	if j.options.Checkpoint != "" {
+		j.checkpoint = &checkpointer{
+			path:     j.options.Checkpoint,
+			interval: j.options.CheckpointInterval,
+			current:  Checkpoint{InputOffset: j.startOffset, Line: j.startLine},
+			lastSave: time.Now(),
+		}
+		if j.options.Resume != nil {
+			j.checkpoint.current.OutputOffset = j.options.Resume.OutputOffset
+		}
+	}
+	j.stats.lastOffset = j.startOffset
+
+	// cancelled once the join finishes, so that the
+	// reader doesn't stay blocked if it stopped early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	j.cancel = cancel
+
+	errorsDone := make(chan struct{})
+	go j.handleErrors(errorsDone)
+	j.stats.start()
+	err := j.run(ctx, input)
+	j.stats.finish()
+	close(j.errors)
+	<-errorsDone
+
+	// a failure is the reason the join was cancelled, so it takes priority
+	if failure := j.failed(); failure != nil {
+		return failure
+	}
+	if err == nil {
+		err = j.checkErrorBudget(j.stats.snapshot().Errored, true)
+	}
+	return err
+}
+
+func (j *joiner) run(ctx context.Context, input io.ReadCloser) error {
+	if j.options.SortedInputs {
+		return j.runMergeJoin(ctx, input)
+	}
+
+	closeIndex, err := j.loadIndex()
+	var tooLarge *indexTooLargeError
+	if errors.As(err, &tooLarge) {
+		if j.checkpoint != nil || j.options.Resume != nil {
+			return fmt.Errorf("the index is too large for the memory budget, and a grace hash join can't be checkpointed or resumed")
 		}
-		j.hashIndex = i
+		return j.runGraceHashJoin(ctx, input, tooLarge)
+	}
+	if err != nil {
+		return err
 	}
+	defer closeIndex()
+	j.stats.indexLoaded(j.hashIndex)
 
-	j.readWG.Add(1)
-	go j.readInput(j.streams.input)
-	go j.handleErrors()
+	j.startReading(ctx, input)
+	writerDone := make(chan struct{})
+	go j.writeResults(writerDone)
 
-	for i := 0; i < j.options.Concurrency; i++ {
+	// workers are numbered from 1 in the logs
+	for i := 1; i <= j.options.Concurrency; i++ {
 		j.writeWG.Add(1)
-		go j.process(i)
+		go j.process(ctx, i)
 	}
 
-	j.readWG.Wait()
 	j.writeWG.Wait()
-	j.drain()
-	close(j.errors)
+	close(j.results)
+	<-writerDone
+	if j.checkpoint != nil && j.failed() == nil {
+		// everything which was written out in order is covered, even if
+		// the join was stopped early. If it failed, the failing row may
+		// be in a block which was written, so the last save is kept.
+		if err := j.checkpoint.save(j.streams.output); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if requiresIndexFile(j.options.Jointype) {
+		j.emitUnmatchedIndexRows()
+	}
+	if j.bloom != nil {
+		j.logger.Debug("bloom filter",
+			"lookups", j.bloomStats.checks, "rejected", j.bloomStats.rejected, "false_positives", j.bloomStats.falsePositives)
+	}
 	return nil
 }
 
-// takes a block of data and joins it from the incoming datastream
-func (j *joiner) process(i int) {
+// stops the join, keeping the first reason for doing so to be returned
+func (j *joiner) fail(err error) {
+	j.failOnce.Do(func() {
+		j.failLock.Lock()
+		j.failure = err
+		j.failLock.Unlock()
+		j.cancel()
+	})
+}
+
+func (j *joiner) failed() error {
+	j.failLock.Lock()
+	defer j.failLock.Unlock()
+	return j.failure
+}
+
+// join types which also output rows from the index file which were
+// never matched, and so can only work with an index file
+func requiresIndexFile(joinType Jointype) bool {
+	return joinType == JoinTypeRight || joinType == JoinTypeFull || joinType == JoinTypeLeftIsNull
+}
+
+// takes blocks of data and joins them from the incoming datastream, until
+// the reader closes the channel at the end of the stream or the join is
+// cancelled. A block which has been started is always finished, and when
+// the join is interrupted rather than failing, so are the blocks which
+// were already read and waiting to be joined.
+func (j *joiner) process(ctx context.Context, i int) {
+	defer j.writeWG.Done()
+	logger := j.logger.With("worker", i)
 	for {
-		j.critLock.RLock()
-		if !j.moreContent {
-			j.critLock.RUnlock()
-			break
-		}
-		j.critLock.RUnlock()
-		datablock := <-j.incoming
-		if len(datablock) == 0 {
-			// channel is likely closed, nil data
-			// so just hang tight and loop again in sec
-			// to check if the content's done
-			time.Sleep(time.Microsecond)
+		select {
+		case <-ctx.Done():
+			if j.failed() == nil {
+				j.drainIncoming(i, logger)
+			}
+			return
+		case datablock, ok := <-j.incoming:
+			if !ok {
+				return
+			}
+			j.processBlock(i, logger, datablock)
+		}
+	}
+}
+
+// joins whatever blocks are left waiting once the join is interrupted,
+// without waiting on the reader for any more
+func (j *joiner) drainIncoming(i int, logger *slog.Logger) {
+	for {
+		select {
+		case datablock, ok := <-j.incoming:
+			if !ok {
+				return
+			}
+			j.processBlock(i, logger, datablock)
+		default:
+			return
+		}
+	}
+}
+
+func (j *joiner) processBlock(i int, logger *slog.Logger, datablock block) {
+	var out bytes.Buffer
+	errored := false
+	for _, rec := range datablock.records {
+		start := j.metrics.joinLatency.start()
+		joinResults, err := j.join(rec.data)
+		j.metrics.joinLatency.observeSince(start)
+		if err == nil {
+			err = j.writeResultsTo(&out, logger, joinResults, rec)
+		}
+		if err != nil {
+			j.workerRowFailed(i, rec, err)
+			errored = true
 			continue
 		}
-		for _, line := range datablock {
-			joinResult, err := j.join(line)
-			if err != nil {
-				j.errors <- fmt.Errorf("%v, original data: %q", err, line)
-				continue
+		j.stats.rowJoined(joinedKey(joinResults))
+	}
+	j.results <- blockResult{seq: datablock.seq, output: out.Bytes(), end: datablock.end, lastLine: datablock.lastLine, errored: errored}
+}
+
+// writes the output of each block as the workers finish joining them. With
+// PreserveOrder, blocks which are finished early are held until the blocks
+// before them are written out, so that the output is in the same order as the
+// input. The window limits how far ahead of the writer the reader can get, and
+// so how many blocks can be held.
+//
+// The last offset is only moved on once all of the blocks before it
+// are written, so that everything before it is known to be done.
+func (j *joiner) writeResults(done chan struct{}) {
+	defer close(done)
+	pending := map[int]blockResult{}
+	next := 0
+	ends := map[int]int64{}
+	nextEnd := 0
+	for res := range j.results {
+		ends[res.seq] = res.end
+		for {
+			end, ok := ends[nextEnd]
+			if !ok {
+				break
 			}
-			err = j.writeOutResult(*joinResult, line)
-			if err != nil {
-				j.errors <- err
-				continue
+			atomic.StoreInt64(&j.stats.lastOffset, end)
+			delete(ends, nextEnd)
+			nextEnd++
+		}
+		if !j.options.PreserveOrder {
+			j.streams.output.Write(res.output)
+			continue
+		}
+		pending[res.seq] = res
+		for {
+			out, ok := pending[next]
+			if !ok {
+				break
+			}
+			j.streams.output.Write(out.output)
+			delete(pending, next)
+			next++
+			<-j.window
+			if j.checkpoint != nil {
+				if out.errored && !j.toleratesRowErrors() {
+					// the join fails on the row, so it mustn't be skipped over on resuming
+					j.checkpoint.halted = true
+				}
+				j.checkpoint.commit(out)
+				if err := j.checkpoint.maybeSave(j.streams.output); err != nil {
+					j.fail(err)
+				}
 			}
 		}
 	}
-	j.writeWG.Done()
+	// anything left is after a gap, so write it out in order
+	remaining := make([]int, 0, len(pending))
+	for seq := range pending {
+		remaining = append(remaining, seq)
+	}
+	sort.Ints(remaining)
+	for _, seq := range remaining {
+		j.streams.output.Write(pending[seq].output)
+	}
 }
 
-func (j *joiner) drain() {
-	for i := 0; i < len(j.incoming); i++ {
-		datablock := <-j.incoming
-		for _, line := range datablock {
-			j.join(line)
+// writes out the result straight away, for the rows of the index which
+// weren't matched and the rows without a key. They aren't rows of the
+// incoming stream which can be skipped, so one which can't be written
+// out fails the join.
+func (j *joiner) writeOutResult(res Result, rec record) {
+	if err := j.writeResultTo(j.streams.output, j.logger, res, rec); err != nil {
+		j.errors <- err
+	}
+}
+
+// writes out all of the results of a row, or none of them if one
+// can't be written out, so that the row can be reported as failed
+func (j *joiner) writeResultsTo(out *bytes.Buffer, logger *slog.Logger, results []Result, rec record) error {
+	mark := out.Len()
+	for _, res := range results {
+		if err := j.writeResultTo(out, logger, res, rec); err != nil {
+			out.Truncate(mark)
+			return err
 		}
 	}
+	return nil
 }
 
-func (j *joiner) writeOutResult(res Result, leftRow string) error {
-	if res.Left == nil {
-		j.debugPrint("No data found in left side. query %q. Data: ", leftRow+"\n", j.options.LeftQueryOptions.JsonSubquery)
+// writes out the result if it's one which the join type includes. The record
+// is the row of the incoming stream it came from, if there was one.
+func (j *joiner) writeResultTo(w io.Writer, logger *slog.Logger, res Result, rec record) error {
+	if res.Left == nil && res.Right == nil {
+		logger.Debug("no join key found in row", rec.lineAttr(), "row", rec.data)
 		return nil
 	}
 	if res.SuccessfulJoin(j.options.Jointype) {
-		fmt.Fprintf(j.streams.output, "%v\n", res.String())
-	} else {
-		j.debugPrint("no join", "%s\n", res.String())
+		d, err := res.marshal()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", d)
+	} else if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug("no join", rec.lineAttr(), "key", res.key(), "result", res.String())
 	}
 	return nil
 }
 
-func (j joiner) debugPrint(debugMsg string, fmtStr string, args ...interface{}) {
-	if j.options.OutputDebugMode {
-		// todo either use a real logging framework
-		// or use string builder properly
-		j.streams.err.Write([]byte(fmt.Sprintf("\033[33m"+debugMsg+"\033[0m "+fmtStr, args...)))
-	}
-}
-
-func (j joiner) handleErrors() {
-	for {
-		err := <-j.errors
-		if err == nil {
-			break // closing & cleaning up
-		}
-		if err != nil && !j.options.ContinueOnErr {
-			log.Fatalf("Fatal error: %v", err)
-		} else {
-			// todo either use a real logging framework
-			// or use string builder properly
-			j.streams.err.Write([]byte(fmt.Sprintf("\033[31mError:\033[0m '%v' \n", err.Error())))
+// reports errors as they happen until the errors channel is closed. Rows which
+// couldn't be joined are skipped with ContinueOnErr or an error budget, but
+// anything else fails the join.
+func (j *joiner) handleErrors(done chan struct{}) {
+	defer close(done)
+	// the rows which have been reported so far, which the stats can be ahead of
+	var errored int64
+	for err := range j.errors {
+		var rowErr *RowError
+		if !errors.As(err, &rowErr) {
+			// keep receiving, so nothing is left blocked on sending an error
+			j.fail(err)
+			continue
+		}
+		errored++
+		if rejectErr := j.reject(rowErr); rejectErr != nil {
+			j.fail(rejectErr)
+			continue
+		}
+		if !j.toleratesRowErrors() {
+			j.fail(err)
+			continue
+		}
+		if budgetErr := j.checkErrorBudget(errored, false); budgetErr != nil {
+			j.fail(budgetErr)
+			continue
+		}
+		if j.options.Rejects == nil {
+			j.logger.Warn("skipped a row which couldn't be joined", rowErr.logAttrs()...)
 		}
 	}
 }
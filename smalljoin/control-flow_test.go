@@ -1,6 +1,10 @@
 package smalljoin
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,6 +24,7 @@ start - line 4 - end
 		prevRemainder     string
 		input             []byte
 		expectedBlock     []string
+		expectedOffsets   []int64
 		expectedRemainder string
 	}{
 		"simple three lines, where the third isn't terminated": {
@@ -29,6 +34,7 @@ start - line 4 - end
 				"start - line 1 - end",
 				"start - line 2 - end",
 			},
+			expectedOffsets:   []int64{0, 21},
 			expectedRemainder: "start - line 3 ...",
 		},
 		"simple lines with whitespace for complete lines, but not partials": {
@@ -40,6 +46,7 @@ start - line 4 - end
 				"test 1",
 				"test 2",
 			},
+			expectedOffsets:   []int64{0, 10},
 			expectedRemainder: "\t\t\t\ttest three...  ", // don't remove whitespace, because this is a partial
 		},
 		"simple continuation": {
@@ -49,13 +56,218 @@ start - line 4 - end
 				"start - line 3 ...- end",
 				"start - line 4 - end",
 			},
+			expectedOffsets:   []int64{0, 24},
 			expectedRemainder: "",
 		},
 	}
 
 	for name, td := range tests {
-		out, remaining := splitInputBytes(td.prevRemainder, td.input)
-		assert.Equal(t, td.expectedRemainder, remaining, name)
-		assert.Equal(t, td.expectedBlock, out)
+		splitter := recordSplitter{remainder: td.prevRemainder, line: 1}
+		out := splitter.split(td.input)
+		assert.Equal(t, td.expectedRemainder, splitter.remainder, name)
+		var lines []string
+		var offsets []int64
+		for i, rec := range out {
+			lines = append(lines, rec.data)
+			offsets = append(offsets, rec.offset)
+			assert.Equal(t, int64(i+1), rec.line, name)
+		}
+		assert.Equal(t, td.expectedBlock, lines, name)
+		assert.Equal(t, td.expectedOffsets, offsets, name)
 	}
 }
+
+func TestQuotedRecordSplitting(t *testing.T) {
+	type rec struct {
+		data   string
+		line   int64
+		offset int64
+	}
+	tests := map[string]struct {
+		input            string
+		quoted           bool
+		backslashEscapes bool
+		dialect          CSVDialect
+		expected         []rec
+	}{
+		"a newline in a quoted column doesn't end the record": {
+			input:  "1,\"a\nb\",x\n2,c,y\n",
+			quoted: true,
+			expected: []rec{
+				{"1,\"a\nb\",x", 1, 0},
+				{"2,c,y", 3, 10},
+			},
+		},
+		"doubled quotes don't close the column": {
+			input:  "1,\"a \"\"quoted\"\"\nb\"\n2,\"\"\n",
+			quoted: true,
+			expected: []rec{
+				{"1,\"a \"\"quoted\"\"\nb\"", 1, 0},
+				{"2,\"\"", 3, 19},
+			},
+		},
+		"a quote partway through a column is just part of it": {
+			input:  "1,a\"b\n2,\"c\"d\ne\"\n",
+			quoted: true,
+			expected: []rec{
+				{"1,a\"b", 1, 0},
+				{"2,\"c\"d\ne\"", 2, 6},
+			},
+		},
+		"backslash escaped quotes": {
+			input:   "1,\"a\\\",\nb\"\n2\n",
+			quoted:  true,
+			dialect: CSVDialect{Escape: EscapeBackslash},
+			expected: []rec{
+				{"1,\"a\\\",\nb\"", 1, 0},
+				{"2", 3, 11},
+			},
+		},
+		"cleaning backslash escaped quotes, except before the end of a column": {
+			input:            "1,\"a \\\"b\\\" c\nd\"\n2,\"C:\\dir\\\",x\n",
+			quoted:           true,
+			backslashEscapes: true,
+			expected: []rec{
+				{"1,\"a \\\"b\\\" c\nd\"", 1, 0},
+				{"2,\"C:\\dir\\\",x", 3, 16},
+			},
+		},
+		"comments are skipped, even with quotes in them": {
+			input:   "# a \"comment\n1,a\n#\n2,b\n#",
+			quoted:  true,
+			dialect: CSVDialect{Comment: "#"},
+			expected: []rec{
+				{"1,a", 2, 13},
+				{"2,b", 4, 19},
+			},
+		},
+		"a quote after leading space only quotes the column when trimming": {
+			input:   "1, \"a\nb\"\n",
+			quoted:  true,
+			dialect: CSVDialect{TrimLeadingSpace: true},
+			expected: []rec{
+				{"1, \"a\nb\"", 1, 0},
+			},
+		},
+		"another quote character": {
+			input:   "1,'a\nb'\n2,\"c\n",
+			quoted:  true,
+			dialect: CSVDialect{Quote: '\''},
+			expected: []rec{
+				{"1,'a\nb'", 1, 0},
+				{"2,\"c", 3, 8},
+			},
+		},
+		"crlf line endings": {
+			input:  "1,\"a\r\nb\"\r\n2,c\r\n",
+			quoted: true,
+			expected: []rec{
+				{"1,\"a\r\nb\"", 1, 0},
+				{"2,c", 3, 10},
+			},
+		},
+		"an unclosed quote runs to the end of the stream": {
+			input:  "1,\"a\n2,b\n",
+			quoted: true,
+			expected: []rec{
+				{"1,\"a\n2,b", 1, 0},
+			},
+		},
+		"quotes are ignored when not splitting CSV": {
+			input: "1,\"a\nb\"\n",
+			expected: []rec{
+				{"1,\"a", 1, 0},
+				{"b\"", 2, 5},
+			},
+		},
+	}
+
+	for name, td := range tests {
+		// the records should be the same however the stream is broken up into reads
+		for chunkSize := 1; chunkSize <= len(td.input); chunkSize++ {
+			q := QueryOptions{Separator: ",", JoinColumn: -1, AttemptToClean: td.backslashEscapes, Dialect: td.dialect}
+			if td.quoted {
+				q.JoinColumn = 0
+			}
+			splitter := newRecordSplitter(q, 1, 0)
+			var out []rec
+			for i := 0; i < len(td.input); i += chunkSize {
+				end := i + chunkSize
+				if end > len(td.input) {
+					end = len(td.input)
+				}
+				for _, r := range splitter.split([]byte(td.input[i:end])) {
+					out = append(out, rec{r.data, r.line, r.offset})
+				}
+			}
+			for _, r := range splitter.flush() {
+				out = append(out, rec{r.data, r.line, r.offset})
+			}
+			assert.Equal(t, td.expected, out, "%s, in reads of %d bytes", name, chunkSize)
+			assert.Equal(t, int64(len(td.input)), splitter.offset, name)
+		}
+	}
+}
+
+func TestWriteResultTo(t *testing.T) {
+	j := New(ioutil.NopCloser(strings.NewReader("")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{Jointype: JoinTypeLeft}).(*joiner)
+	tests := map[string]struct {
+		res      Result
+		expected string
+		err      string
+	}{
+		"a row of JSON": {
+			res:      Result{Left: &LeftResult{Index: "a", Row: `{"id":"a"}`, rowJSON: true}},
+			expected: `{"Left":{"Index":"a","Row":{"id":"a"}},"Right":null}` + "\n",
+		},
+		"a row of JSON which isn't valid": {
+			res: Result{Left: &LeftResult{Index: "b", Row: `{"id":`, rowJSON: true}},
+			err: `failed to write out the result for key "b": `,
+		},
+	}
+	for name, test := range tests {
+		out := bytes.NewBuffer(nil)
+		err := j.writeResultTo(out, j.logger, test.res, record{})
+		assert.Equal(t, test.expected, out.String(), name)
+		if test.err == "" {
+			assert.NoError(t, err, name)
+			assert.Equal(t, test.expected, test.res.String()+"\n", name)
+			continue
+		}
+		// the rest is the error from encoding/json
+		if assert.Error(t, err, name) {
+			assert.True(t, strings.HasPrefix(err.Error(), test.err), name)
+			assert.Equal(t, "%!("+err.Error()+")", test.res.String(), name)
+		}
+		assert.Equal(t, ErrorCategoryJSON, ErrorCategory(err), name)
+	}
+}
+
+func TestProcessBlockUnwritableResult(t *testing.T) {
+	j := New(ioutil.NopCloser(strings.NewReader("")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		Jointype:          JoinTypeInner,
+		IndexFile:         "index",
+		Concurrency:       1,
+		LeftQueryOptions:  QueryOptions{JoinColumn: -1},
+		RightQueryOptions: QueryOptions{JoinColumn: -1, Format: FormatNDJSON},
+	}).(*joiner)
+	// the second row of the index can't be embedded in the output as JSON
+	j.hashIndex = rightIndex{"a": {{data: `{"id":"a"}`}}, "b": {{data: `{"id":`}, {data: `{"id":"b"}`}}}
+	j.errors = make(chan error, 1)
+
+	j.processBlock(1, j.logger, block{records: []record{{data: "a", line: 1}, {data: "b", line: 2, offset: 2}}})
+
+	// none of the failed row's results are written out
+	res := <-j.results
+	assert.Equal(t, `{"Left":{"Index":"a","Row":"a"},"Right":{"IndexFileResult":{"Index":"a","Row":{"id":"a"}}}}`+"\n", string(res.output))
+	assert.True(t, res.errored)
+	var rowErr *RowError
+	if assert.True(t, errors.As(<-j.errors, &rowErr)) {
+		assert.Equal(t, int64(2), rowErr.Line)
+		assert.Equal(t, ErrorCategoryJSON, ErrorCategory(rowErr))
+	}
+	stats := j.Stats()
+	assert.Equal(t, int64(1), stats.Matched)
+	assert.Equal(t, int64(1), stats.Errored)
+	assert.Equal(t, map[string]int64{ErrorCategoryJSON: 1}, stats.ErrorsByCategory)
+}
@@ -0,0 +1,261 @@
+package smalljoin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// QuoteEscape is how a quote is escaped inside a quoted column
+type QuoteEscape int
+
+const (
+	// quotes are doubled, eg "a ""quoted"" word". With AttemptToClean, a
+	// backslash before a quote also escapes it, unless the quote is followed
+	// by the end of the column, eg "C:\dir\",next
+	EscapeDefault QuoteEscape = iota
+	// quotes can only be doubled, and backslashes are always kept as they are
+	EscapeDoubled
+	// a backslash escapes a quote, the separator or another backslash,
+	// eg "a \"quoted\" word", as in MySQL dumps. Doubled quotes are still allowed.
+	EscapeBackslash
+)
+
+// CSVDialect describes how the columns of a CSV are quoted. Setting any of it
+// splits the columns as a CSV for separators other than a comma as well.
+// The zero value quotes with ", and keeps stray quotes as part of a column.
+type CSVDialect struct {
+	// Quote is the character which quotes a column, " if it isn't set
+	Quote  rune
+	Escape QuoteEscape
+	// Comment is a prefix for rows which are skipped, eg #
+	Comment string
+	// TrimLeadingSpace ignores spaces and tabs at the start of each column,
+	// so that a quote after them still quotes the column
+	TrimLeadingSpace bool
+	// Strict fails rows with quotes which don't open or close a column,
+	// or which aren't closed, rather than keeping them as part of it
+	Strict bool
+}
+
+// the dialects which can be chosen by name with CSVDialectPreset
+var csvDialectPresets = map[string]CSVDialect{
+	"rfc4180":  {Escape: EscapeDoubled, Strict: true},
+	"excel":    {Escape: EscapeDoubled},
+	"postgres": {Escape: EscapeDoubled, Strict: true},
+	"mysql":    {Escape: EscapeBackslash},
+}
+
+// CSVDialectPreset gives the dialect of the given name: rfc4180, excel, postgres or mysql
+func CSVDialectPreset(name string) (CSVDialect, error) {
+	d, ok := csvDialectPresets[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(csvDialectPresets))
+		for n := range csvDialectPresets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return CSVDialect{}, fmt.Errorf("not a valid CSV dialect %q, options are: %s", name, strings.Join(names, ", "))
+	}
+	return d, nil
+}
+
+func (d CSVDialect) validate(separator string) error {
+	if d.Quote < 0 || d.Quote > 127 {
+		return fmt.Errorf("the quote character %q isn't a single byte", d.Quote)
+	}
+	if d == (CSVDialect{}) {
+		return nil
+	}
+	if len(separator) > 1 && separator != SeparatorAuto {
+		return fmt.Errorf("a CSV dialect can only be used with a single character separator, not %q", separator)
+	}
+	if separator != "" && rune(separator[0]) == d.quote() {
+		return fmt.Errorf("the quote character %q can't be the separator too", d.Quote)
+	}
+	return nil
+}
+
+func (d CSVDialect) quote() rune {
+	if d.Quote == 0 {
+		return '"'
+	}
+	return d.Quote
+}
+
+// the rules for splitting up a row, resolved from its query options
+type csvRules struct {
+	separator byte
+	quote     byte
+	// whether a backslash always escapes, or only before a quote which
+	// doesn't end the column, as with AttemptToClean
+	backslash      bool
+	cleanBackslash bool
+	trim           bool
+	strict         bool
+	comment        string
+}
+
+func (q QueryOptions) csvRules() csvRules {
+	r := csvRules{
+		quote:          byte(q.Dialect.quote()),
+		backslash:      q.Dialect.Escape == EscapeBackslash,
+		cleanBackslash: q.Dialect.Escape == EscapeDefault && q.AttemptToClean,
+		trim:           q.Dialect.TrimLeadingSpace,
+		strict:         q.Dialect.Strict,
+		comment:        q.Dialect.Comment,
+	}
+	if len(q.Separator) == 1 {
+		r.separator = q.Separator[0]
+	}
+	return r
+}
+
+func (r csvRules) isComment(row string) bool {
+	return r.comment != "" && strings.HasPrefix(row, r.comment)
+}
+
+// what a byte inside a quoted column is, given the bytes which follow it
+type quotedByte int
+
+const (
+	quotedLiteral quotedByte = iota
+	// the byte and the one after it are an escape for the one after it
+	quotedEscape
+	quotedClose
+	// a quote which doesn't close the column
+	quotedStray
+	// it can't be told without more of the row
+	quotedNeedMore
+)
+
+// classifies the byte at i of s, which is inside a quoted column. Unless
+// atEnd is set, s may only be part of the way through a record, so a
+// byte at the end of it may depend on what's read next.
+func (r csvRules) quotedByte(s string, i int, atEnd bool) quotedByte {
+	c := s[i]
+	isBackslash := c == '\\' && (r.backslash || r.cleanBackslash)
+	if c != r.quote && !isBackslash {
+		return quotedLiteral
+	}
+	if i+1 == len(s) {
+		switch {
+		case !atEnd:
+			return quotedNeedMore
+		case c == r.quote:
+			return quotedClose
+		}
+		return quotedLiteral
+	}
+	next := s[i+1]
+	if isBackslash {
+		switch {
+		case r.backslash && (next == r.quote || next == '\\' || next == r.separator):
+			return quotedEscape
+		case r.cleanBackslash && next == r.quote:
+			// \" at the end of the column is a backslash at the end of it
+			if i+2 == len(s) {
+				if !atEnd {
+					return quotedNeedMore
+				}
+				return quotedLiteral
+			}
+			if after := s[i+2]; after == r.separator || after == '\n' || after == '\r' {
+				return quotedLiteral
+			}
+			return quotedEscape
+		}
+		return quotedLiteral
+	}
+	switch next {
+	case r.quote:
+		return quotedEscape
+	case r.separator, '\n', '\r':
+		return quotedClose
+	}
+	return quotedStray
+}
+
+// splits a row up into its columns
+func (r csvRules) split(row string) ([]string, error) {
+	var columns []string
+	var column strings.Builder
+	i := 0
+	for {
+		if r.trim {
+			for i < len(row) && (row[i] == ' ' || row[i] == '\t') && row[i] != r.separator {
+				i++
+			}
+		}
+		if i < len(row) && row[i] == r.quote {
+			start := i
+			closed := false
+			for i++; i < len(row) && !closed; {
+				kind := r.quotedByte(row, i, true)
+				if kind == quotedClose && i+1 < len(row) && row[i+1] != r.separator {
+					kind = quotedStray
+				}
+				switch kind {
+				case quotedEscape:
+					column.WriteByte(row[i+1])
+					i += 2
+				case quotedClose:
+					closed = true
+					i++
+				case quotedStray:
+					if r.strict {
+						return nil, fmt.Errorf("extraneous %q in the quoted column starting at byte %d", r.quote, start)
+					}
+					fallthrough
+				default:
+					column.WriteByte(row[i])
+					i++
+				}
+			}
+			if !closed && r.strict {
+				return nil, fmt.Errorf("the quoted column starting at byte %d isn't closed", start)
+			}
+		} else {
+			end, err := r.unquoted(row, i, &column)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		}
+		columns = append(columns, column.String())
+		column.Reset()
+		if i >= len(row) {
+			return columns, nil
+		}
+		// past the separator
+		i++
+	}
+}
+
+// reads the unquoted column starting at i into column, returning where it ends
+func (r csvRules) unquoted(row string, i int, column *strings.Builder) (int, error) {
+	if !r.backslash && !r.strict {
+		end := len(row)
+		if next := strings.IndexByte(row[i:], r.separator); next >= 0 {
+			end = i + next
+		}
+		column.WriteString(row[i:end])
+		return end, nil
+	}
+	start := i
+	for ; i < len(row) && row[i] != r.separator; i++ {
+		c := row[i]
+		if r.backslash && c == '\\' && i+1 < len(row) {
+			if next := row[i+1]; next == '\\' || next == r.separator || next == r.quote {
+				column.WriteByte(next)
+				i++
+				continue
+			}
+		}
+		if c == r.quote && r.strict {
+			return 0, fmt.Errorf("extraneous %q in the unquoted column starting at byte %d", r.quote, start)
+		}
+		column.WriteByte(c)
+	}
+	return i, nil
+}
@@ -0,0 +1,114 @@
+package smalljoin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVDialectSplit(t *testing.T) {
+	tests := map[string]struct {
+		row            string
+		separator      string
+		dialect        CSVDialect
+		attemptToClean bool
+		expected       []string
+		expectedErr    bool
+	}{
+		"plain columns": {
+			row:      `a,b,,c`,
+			expected: []string{"a", "b", "", "c"},
+		},
+		"quoted columns with doubled quotes and separators": {
+			row:      `"a ""quoted"" word","b,c",d`,
+			expected: []string{`a "quoted" word`, "b,c", "d"},
+		},
+		"stray quotes are kept by default": {
+			row:      `a"b,"c"d",e`,
+			expected: []string{`a"b`, `c"d`, "e"},
+		},
+		"stray quotes fail when strict": {
+			row:         `"c"d",e`,
+			dialect:     CSVDialect{Strict: true},
+			expectedErr: true,
+		},
+		"quotes in unquoted columns fail when strict": {
+			row:         `a"b,c`,
+			dialect:     CSVDialect{Strict: true},
+			expectedErr: true,
+		},
+		"unclosed quotes fail when strict": {
+			row:         `a,"b`,
+			dialect:     CSVDialect{Strict: true},
+			expectedErr: true,
+		},
+		"backslashes are kept as they are when quotes are doubled": {
+			row:      `"a \"b",c`,
+			dialect:  CSVDialect{Escape: EscapeDoubled},
+			expected: []string{`a \"b`, "c"},
+		},
+		"backslash escapes": {
+			row:      `"a \"b\" \\ \, c",d\,e,f\\`,
+			dialect:  CSVDialect{Escape: EscapeBackslash},
+			expected: []string{`a "b" \ , c`, "d,e", `f\`},
+		},
+		"cleaning backslash escaped quotes": {
+			row:            `"{\"data\": {\"index\":\"a"}}",b`,
+			attemptToClean: true,
+			expected:       []string{`{"data": {"index":"a"}}`, "b"},
+		},
+		"cleaning doesn't unescape a backslash at the end of a column": {
+			row:            `"C:\dir\",next`,
+			attemptToClean: true,
+			expected:       []string{`C:\dir\`, "next"},
+		},
+		"another quote character": {
+			row:      `'a,b','c''d',"e`,
+			dialect:  CSVDialect{Quote: '\''},
+			expected: []string{"a,b", "c'd", `"e`},
+		},
+		"trimming leading space": {
+			row:      `a,  "b, c",	d`,
+			dialect:  CSVDialect{TrimLeadingSpace: true},
+			expected: []string{"a", "b, c", "d"},
+		},
+		"leading space is kept otherwise": {
+			row:      `a, "b"`,
+			expected: []string{"a", ` "b"`},
+		},
+		"another separator": {
+			row:       `a;"b;c"`,
+			separator: ";",
+			dialect:   CSVDialect{Escape: EscapeDoubled},
+			expected:  []string{"a", "b;c"},
+		},
+	}
+
+	for name, td := range tests {
+		if td.separator == "" {
+			td.separator = ","
+		}
+		q := QueryOptions{Separator: td.separator, Dialect: td.dialect, AttemptToClean: td.attemptToClean}
+		columns, err := splitColumns(td.row, q)
+		if td.expectedErr {
+			assert.Error(t, err, name)
+			assert.Equal(t, ErrorCategoryCSV, ErrorCategory(err), name)
+			continue
+		}
+		assert.NoError(t, err, name)
+		assert.Equal(t, td.expected, columns, name)
+	}
+}
+
+func TestCSVDialectValidation(t *testing.T) {
+	assert.NoError(t, CSVDialect{}.validate("||"))
+	assert.NoError(t, CSVDialect{Quote: '\''}.validate(","))
+	assert.Error(t, CSVDialect{Quote: '“'}.validate(","))
+	assert.Error(t, CSVDialect{Strict: true}.validate("||"))
+	assert.Error(t, CSVDialect{Quote: ','}.validate(","))
+
+	_, err := CSVDialectPreset("MySQL")
+	assert.NoError(t, err)
+	_, err = CSVDialectPreset("lotus-123")
+	assert.Error(t, err)
+}
@@ -0,0 +1,323 @@
+package smalljoin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const maxGraceBuckets = 256
+
+// the most times a bucket which is still too large is partitioned again.
+// Past that it's most likely down to a key with more rows than fit in the
+// budget, which partitioning can't split up, so it's joined anyway.
+const maxGraceLevels = 4
+
+// a row written out to one of the buckets, along with
+// its key so that it doesn't need to be parsed again
+type bucketRecord struct {
+	Key    string `json:"k"`
+	Row    string `json:"r"`
+	Offset int64  `json:"o,omitempty"`
+	Line   int    `json:"l,omitempty"`
+}
+
+// a set of bucket files, which rows are partitioned into by the hash of their key
+type buckets struct {
+	files   []*os.File
+	writers []*bufio.Writer
+	// the estimated memory needed to index each bucket
+	sizes []int64
+	// how many times the rows have been partitioned, which the hash is seeded
+	// with so that a bucket's rows are spread out when it's partitioned again
+	level int
+}
+
+func createBuckets(dir string, name string, n int, level int) (*buckets, error) {
+	b := &buckets{sizes: make([]int64, n), level: level}
+	for i := 0; i < n; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s-%d", name, i)))
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		b.files = append(b.files, f)
+		b.writers = append(b.writers, bufio.NewWriter(f))
+	}
+	return b, nil
+}
+
+func (b *buckets) write(rec bucketRecord) error {
+	d, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	i := bucketFor(rec.Key, len(b.writers), b.level)
+	// the index of a bucket keeps each of its rows in memory
+	b.sizes[i] += int64(len(rec.Row)) + indexEntryOverhead
+	w := b.writers[i]
+	if _, err := w.Write(d); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+func (b *buckets) close() error {
+	var firstErr error
+	for i := range b.files {
+		if err := b.writers[i].Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := b.files[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func readBucket(path string, fn func(rec bucketRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var rec bucketRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bucket %q: %w", path, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func bucketFor(key string, n int, level int) int {
+	h := fnv.New32a()
+	h.Write([]byte{byte(level)})
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// picks enough buckets for each of them to fit within the memory budget. The
+// buckets keep their rows in memory whatever the index mode, so it goes by the
+// size of the index file, plus the overhead of each of its rows, extrapolating
+// the number of rows from how many were read before it went over.
+func graceBucketCount(indexFileSize int64, tooLarge *indexTooLargeError, maxMemory int64) int {
+	estimatedTotal := indexFileSize
+	if tooLarge.bytesRead > 0 {
+		estimatedTotal += int64(float64(tooLarge.rows*indexEntryOverhead) * float64(indexFileSize) / float64(tooLarge.bytesRead))
+	}
+	return bucketCount(estimatedTotal, maxMemory)
+}
+
+func bucketCount(estimatedTotal int64, maxMemory int64) int {
+	// double it, to leave room for keys which aren't evenly spread
+	n := int(2*estimatedTotal/maxMemory) + 1
+	if n < 2 {
+		n = 2
+	}
+	if n > maxGraceBuckets {
+		n = maxGraceBuckets
+	}
+	return n
+}
+
+// runGraceHashJoin is used when the index won't fit into the memory budget.
+// It partitions both the index file and the incoming stream into buckets on
+// disk by the hash of their keys, so that matching rows end up in the same
+// bucket, and then hash joins each pair of buckets in turn. Any bucket which
+// is still too large for the budget, from keys which weren't evenly spread, is
+// partitioned again before it's joined. The buckets are removed once it's
+// done, whether or not it succeeded.
+func (j *joiner) runGraceHashJoin(ctx context.Context, input io.ReadCloser, tooLarge *indexTooLargeError) error {
+	s, err := os.Stat(j.options.IndexFile)
+	if err != nil {
+		return err
+	}
+	n := graceBucketCount(s.Size(), tooLarge, j.options.MaxMemory)
+
+	dir, err := os.MkdirTemp("", "small-join-")
+	if err != nil {
+		return fmt.Errorf("failed to create a directory for the grace hash join: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	j.logger.Debug("the index is too large for the memory budget, partitioning it for a grace hash join", "buckets", n, "dir", dir)
+
+	// the results are written out bucket by bucket, so
+	// they can't be put back into the order of the input
+	j.window = nil
+	j.startReading(ctx, input)
+
+	sizes, err := j.partitionIndexFile(dir, n)
+	if err != nil {
+		return err
+	}
+	end, err := j.partitionIncoming(dir, n)
+	if err != nil {
+		return err
+	}
+	if err := j.joinBuckets(ctx, dir, "", sizes, 0); err != nil {
+		return err
+	}
+	j.hashIndex = nil
+	// the rows are only all joined once the last bucket is done
+	atomic.StoreInt64(&j.stats.lastOffset, end)
+	return nil
+}
+
+// joins each of the pairs of buckets named "right<name>-<i>" and
+// "left<name>-<i>", partitioning any which are too large again
+func (j *joiner) joinBuckets(ctx context.Context, dir string, name string, sizes []int64, level int) error {
+	for i, size := range sizes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		bucket := fmt.Sprintf("%s-%d", name, i)
+		if size > j.options.MaxMemory {
+			if level < maxGraceLevels {
+				n := bucketCount(size, j.options.MaxMemory)
+				j.logger.Debug("a bucket is too large for the memory budget, partitioning it again", "bucket", bucket, "estimated_bytes", size, "buckets", n)
+				subSizes, err := repartitionBuckets(dir, bucket, n, level+1)
+				if err != nil {
+					return err
+				}
+				if err := j.joinBuckets(ctx, dir, bucket, subSizes, level+1); err != nil {
+					return err
+				}
+				continue
+			}
+			j.logger.Warn("a bucket is still too large for the memory budget after partitioning it again, most likely from a key with too many rows, so it's joined anyway",
+				"bucket", bucket, "estimated_bytes", size, "max_memory", j.options.MaxMemory)
+		}
+		if err := j.joinBucket(dir, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitions the pair of buckets again into n buckets each, removing them
+// once they're done with, and returns the sizes of the right side's buckets
+func repartitionBuckets(dir string, bucket string, n int, level int) ([]int64, error) {
+	var sizes []int64
+	for _, side := range []string{"right", "left"} {
+		b, err := createBuckets(dir, side+bucket, n, level)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, side+bucket)
+		err = readBucket(path, b.write)
+		if closeErr := b.close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if side == "right" {
+			sizes = b.sizes
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+func (j *joiner) joinBucket(dir string, bucket string) error {
+	index := rightIndex{}
+	err := readBucket(filepath.Join(dir, "right"+bucket), func(rec bucketRecord) error {
+		return index.add(rec.Key, &indexEntry{data: rec.Row, offset: rec.Offset, length: len(rec.Row)}, rec.Line, j.options.DuplicateKeys)
+	})
+	if err != nil {
+		return err
+	}
+	j.hashIndex = index
+	j.stats.indexLoaded(index)
+
+	err = readBucket(filepath.Join(dir, "left"+bucket), func(rec bucketRecord) error {
+		start := j.metrics.joinLatency.start()
+		results, err := j.lookupIndex(rec.Row, rec.Key)
+		j.metrics.joinLatency.observeSince(start)
+		left := record{data: rec.Row, line: int64(rec.Line), offset: rec.Offset}
+		var out bytes.Buffer
+		if err == nil {
+			err = j.writeResultsTo(&out, j.logger, results, left)
+		}
+		if err != nil {
+			j.rowFailed(left, err)
+			return nil
+		}
+		j.stats.rowJoined(joinedKey(results))
+		_, err = j.streams.output.Write(out.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if requiresIndexFile(j.options.Jointype) {
+		j.emitUnmatchedIndexRows()
+	}
+	return nil
+}
+
+// partitions the index file, returning the sizes of the buckets
+func (j *joiner) partitionIndexFile(dir string, n int) ([]int64, error) {
+	b, err := createBuckets(dir, "right", n, 0)
+	if err != nil {
+		return nil, err
+	}
+	queryOptions := j.options.RightQueryOptions
+	err = forEachIndexRow(j.options.IndexFile, queryOptions, func(line string, offset int64, lineNumber int) error {
+		k, err := attemptSplitAndSelectCol(line, queryOptions)
+		if err != nil || k == "" {
+			return err
+		}
+		return b.write(bucketRecord{Key: k, Row: line, Offset: offset, Line: lineNumber})
+	})
+	if closeErr := b.close(); err == nil {
+		err = closeErr
+	}
+	return b.sizes, err
+}
+
+// partitions the incoming stream, returning the byte offset of the end of it
+func (j *joiner) partitionIncoming(dir string, n int) (int64, error) {
+	b, err := createBuckets(dir, "left", n, 0)
+	if err != nil {
+		return 0, err
+	}
+	end := j.startOffset
+	for datablock := range j.incoming {
+		end = datablock.end
+		for _, rec := range datablock.records {
+			k, err := attemptSplitAndSelectCol(rec.data, j.options.LeftQueryOptions)
+			if err != nil {
+				j.rowFailed(rec, err)
+				continue
+			}
+			if k == "" {
+				j.stats.rowJoined("", false)
+				j.writeOutResult(Result{}, rec)
+				continue
+			}
+			if err := b.write(bucketRecord{Key: k, Row: rec.data, Offset: rec.offset, Line: int(rec.line)}); err != nil {
+				b.close()
+				return 0, err
+			}
+		}
+	}
+	return end, b.close()
+}
@@ -0,0 +1,140 @@
+package smalljoin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraceHashJoin(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	inputStream, err := os.Open("internal/testdata/testdata_3")
+	if err != nil {
+		t.FailNow()
+	}
+
+	j := New(inputStream, outStream, errStream, Options{
+		Jointype:  JoinTypeFull,
+		IndexFile: "internal/testdata/index_4",
+		// small enough that the index won't fit
+		MaxMemory: 150,
+		RightQueryOptions: QueryOptions{
+			Separator: ",",
+		},
+		LeftQueryOptions: QueryOptions{
+			Separator:      ",",
+			JsonSubquery:   "data.index",
+			AttemptToClean: true,
+			JoinColumn:     4,
+		},
+	})
+	err = j.Run()
+	assert.NoError(t, err)
+
+	sortAndCompare(t, `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"y","Row":"y"}}}
+{"Left":null,"Right":{"IndexFileResult":{"Index":"z","Row":"z"}}}
+{"Left":{"Index":"a","Row":"1,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"a\"}}\""},"Right":{"IndexFileResult":{"Index":"a","Row":"a"}}}
+{"Left":{"Index":"b","Row":"2,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"b\"}}\""},"Right":{"IndexFileResult":{"Index":"b","Row":"b"}}}
+{"Left":{"Index":"c","Row":"3,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"c\"}}\""},"Right":null}
+{"Left":{"Index":"d","Row":"4,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"d\"}}\""},"Right":null}
+	`, outStream.Bytes())
+
+	// the buckets should've been cleaned up
+	remaining, err := ioutil.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, remaining)
+}
+
+func TestGraceBucketCount(t *testing.T) {
+	// a quarter of the file, 5 rows, was read before reaching 1000 bytes, so
+	// it's 4000 bytes of rows and the overhead of about 20 of them
+	n := graceBucketCount(4000, &indexTooLargeError{bytesRead: 1000, estimatedBytes: 1000, rows: 5}, 1000)
+	assert.Equal(t, 13, n)
+
+	// only the keys of the rows read were counted, with IndexOnDisk,
+	// but the buckets are sized for the whole of each row
+	n = graceBucketCount(4000, &indexTooLargeError{bytesRead: 1000, estimatedBytes: 510, rows: 5}, 1000)
+	assert.Equal(t, 13, n)
+
+	n = graceBucketCount(1<<40, &indexTooLargeError{bytesRead: 1, estimatedBytes: 1000, rows: 1}, 1)
+	assert.Equal(t, maxGraceBuckets, n)
+}
+
+func TestGraceHashJoinRepartitions(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	indexFile := filepath.Join(t.TempDir(), "index")
+
+	tests := map[string]struct {
+		// rows of a key which alone are too many for the budget
+		hotRows int
+		// what should be in the logs
+		expected string
+	}{
+		"more rows than were estimated": {
+			expected: "partitioning it again",
+		},
+		"a key with too many rows": {
+			hotRows:  12,
+			expected: "so it's joined anyway",
+		},
+	}
+	for name, test := range tests {
+		var index, input, expected []string
+		result := func(k string) string {
+			return fmt.Sprintf(`{"Left":{"Index":"%s","Row":"%s"},"Right":{"IndexFileResult":{"Index":"%s","Row":"%s"}}}`, k, k, k, k)
+		}
+		// the first rows are much longer than the rest, so there are far
+		// more rows than are estimated from them, and too many for the
+		// buckets it starts with
+		for i := 0; i < 520; i++ {
+			k := fmt.Sprintf("k%d", i)
+			if i < 20 {
+				k += strings.Repeat("-", 200)
+			}
+			index = append(index, k)
+			input = append(input, k)
+			expected = append(expected, result(k))
+		}
+		for i := 0; i < test.hotRows; i++ {
+			index = append(index, "hot")
+			expected = append(expected, result("hot"))
+		}
+		if test.hotRows > 0 {
+			input = append(input, "hot")
+		}
+		sort.Strings(expected)
+		assert.NoError(t, ioutil.WriteFile(indexFile, []byte(strings.Join(index, "\n")+"\n"), 0644), name)
+
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		j := New(ioutil.NopCloser(strings.NewReader(strings.Join(input, "\n")+"\n")), outStream, errStream, Options{
+			Jointype:  JoinTypeInner,
+			IndexFile: indexFile,
+			// room for nine of the short rows in each bucket
+			MaxMemory:         1000,
+			OutputDebugMode:   true,
+			LeftQueryOptions:  QueryOptions{JoinColumn: -1},
+			RightQueryOptions: QueryOptions{JoinColumn: -1},
+		})
+		assert.NoError(t, j.Run(), name)
+		assert.Contains(t, errStream.String(), test.expected, name)
+		sortAndCompare(t, strings.Join(expected, "\n"), outStream.Bytes())
+
+		remaining, err := ioutil.ReadDir(tmp)
+		assert.NoError(t, err, name)
+		assert.Empty(t, remaining, name)
+	}
+}
@@ -0,0 +1,97 @@
+package smalljoin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// withHeader parses the header row of an input into its column names and
+// resolves any join columns given by name into their zero-based positions.
+// Names which can't be found in the header but are valid integers are
+// treated as column numbers.
+func (q QueryOptions) withHeader(headerRow string) (QueryOptions, error) {
+	if strings.TrimSpace(headerRow) == "" {
+		return q, fmt.Errorf("expected a header row but found an empty line")
+	}
+	columns, err := splitColumns(headerRow, q)
+	if err != nil {
+		return q, fmt.Errorf("failed to parse header row: %w", err)
+	}
+	header := make([]string, len(columns))
+	for i := range columns {
+		header[i] = strings.TrimSpace(columns[i])
+	}
+	q.header = header
+
+	if len(q.JoinColumnNames) == 0 {
+		return q, nil
+	}
+	q.JoinColumns = nil
+	for _, name := range q.JoinColumnNames {
+		col, err := findColumn(header, name)
+		if err != nil {
+			return q, err
+		}
+		q.JoinColumns = append(q.JoinColumns, col)
+	}
+	return q, nil
+}
+
+func findColumn(header []string, name string) (int, error) {
+	for i := range header {
+		if header[i] == name {
+			return i, nil
+		}
+	}
+	if col, err := strconv.Atoi(name); err == nil {
+		return col, nil
+	}
+	return 0, fmt.Errorf("column %q not found in header, found: %s", name, strings.Join(header, ", "))
+}
+
+// labelFields splits the row and labels each of its columns with
+// the name from the header, so that it can be output with the result.
+// Rows which can't be split, or inputs without a header, aren't labelled.
+func (q QueryOptions) labelFields(row string) map[string]string {
+	if q.header == nil {
+		return nil
+	}
+	columns, err := splitColumns(row, q)
+	if err != nil {
+		return nil
+	}
+	out := make(map[string]string, len(q.header))
+	for i, name := range q.header {
+		if i < len(columns) {
+			out[name] = strings.TrimSpace(columns[i])
+		}
+	}
+	return out
+}
+
+// reads the header row of the index file
+func readIndexFileHeader(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header, _, err := readHeaderLine(bufio.NewReader(f))
+	return header, err
+}
+
+// reads the first line of the input, without consuming any more of it
+func readHeaderLine(r *bufio.Reader) (string, int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	if line == "" && err == io.EOF {
+		return "", 0, fmt.Errorf("expected a header row but the input was empty")
+	}
+	return strings.TrimSpace(line), len(line), nil
+}
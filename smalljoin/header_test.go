@@ -0,0 +1,53 @@
+package smalljoin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithHeader(t *testing.T) {
+
+	tests := map[string]struct {
+		queryoptions    QueryOptions
+		header          string
+		expectedColumns []int
+		expectedErr     error
+	}{
+		"columns by name": {
+			queryoptions: QueryOptions{
+				Separator:       ",",
+				JoinColumnNames: []string{"user_id", "tenant_id"},
+			},
+			header:          "tenant_id, name, user_id",
+			expectedColumns: []int{2, 0},
+		},
+		"a mix of names and numbers": {
+			queryoptions: QueryOptions{
+				Separator:       "|",
+				JoinColumnNames: []string{"1", "tenant_id"},
+			},
+			header:          "tenant_id|name|user_id",
+			expectedColumns: []int{1, 0},
+		},
+		"missing column": {
+			queryoptions: QueryOptions{
+				Separator:       ",",
+				JoinColumnNames: []string{"customer_id"},
+			},
+			header:      "tenant_id,name",
+			expectedErr: errors.New(`column "customer_id" not found in header, found: tenant_id, name`),
+		},
+	}
+
+	for name, td := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := td.queryoptions.withHeader(td.header)
+			assert.Equal(t, td.expectedErr, err, name)
+			if err == nil {
+				assert.Equal(t, td.expectedColumns, res.JoinColumns, name)
+			}
+		})
+	}
+}
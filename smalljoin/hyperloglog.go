@@ -0,0 +1,71 @@
+package smalljoin
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// the number of bits of the hash used to pick a register, giving 2^14
+// registers, and so estimates which are within about 1% of the real count
+const hyperLogLogPrecision = 14
+
+// estimates the number of distinct keys in the incoming stream, in a fixed
+// amount of memory no matter how many there are. Keys can be added to it
+// by several workers at once.
+type hyperLogLog struct {
+	registers []uint32
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint32, 1<<hyperLogLogPrecision)}
+}
+
+func (h *hyperLogLog) add(key string) {
+	hash := hashKey(key)
+	idx := hash >> (64 - hyperLogLogPrecision)
+	// the position of the first set bit of the rest of the hash, where
+	// the set bit on the end stops it running past the end
+	rank := uint32(bits.LeadingZeros64(hash<<hyperLogLogPrecision|1<<(hyperLogLogPrecision-1)) + 1)
+	for {
+		current := atomic.LoadUint32(&h.registers[idx])
+		if rank <= current || atomic.CompareAndSwapUint32(&h.registers[idx], current, rank) {
+			return
+		}
+	}
+}
+
+func (h *hyperLogLog) estimate() int64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for i := range h.registers {
+		r := atomic.LoadUint32(&h.registers[i])
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// for small counts, count the registers which are still empty instead
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(e))
+}
+
+// fnv doesn't mix its bits well enough on its own, so they're
+// mixed some more with the finaliser from splitmix64
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h := f.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,29 @@
+package smalljoin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	tests := map[string]struct {
+		distinct int
+		repeats  int
+	}{
+		"empty":              {distinct: 0, repeats: 1},
+		"a few keys":         {distinct: 10, repeats: 3},
+		"many repeated keys": {distinct: 5000, repeats: 4},
+		"lots of keys":       {distinct: 200000, repeats: 1},
+	}
+	for name, td := range tests {
+		h := newHyperLogLog()
+		for r := 0; r < td.repeats; r++ {
+			for i := 0; i < td.distinct; i++ {
+				h.add(fmt.Sprintf("key-%d", i))
+			}
+		}
+		assert.InEpsilon(t, float64(td.distinct+1), float64(h.estimate()+1), 0.03, name)
+	}
+}
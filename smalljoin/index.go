@@ -0,0 +1,273 @@
+package smalljoin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// a rough guess of the memory used by each entry in the index
+// on top of its row: the map's bucket, the slice and the entry itself
+const indexEntryOverhead = 100
+
+// returned when the index would need more than the memory budget
+type indexTooLargeError struct {
+	bytesRead      int64
+	estimatedBytes int64
+	// the rows with keys which had been read
+	rows int64
+}
+
+func (e *indexTooLargeError) Error() string {
+	return fmt.Sprintf("index exceeds the memory budget after reading %d bytes of the index file (estimated %d bytes in memory)", e.bytesRead, e.estimatedBytes)
+}
+
+// reads the right join file and builds an index of it. For IndexInMemory
+// the rows of the file are kept in memory along with their keys. For
+// IndexOnDisk only the keys and the byte offset of each row are kept, and the
+// rows are read back out of the file when they're matched, so the memory
+// needed grows with the number of keys rather than the size of the file.
+//
+// If maxMemory is set, and the estimated size of the index grows past it,
+// an *indexTooLargeError is returned.
+func createIndexMap(right string, queryOptions QueryOptions, duplicates DuplicateKeyPolicy, mode IndexMode, maxMemory int64) (rightIndex, error) {
+	if queryOptions.Header && queryOptions.header == nil {
+		headerRow, err := readIndexFileHeader(right)
+		if err != nil {
+			return nil, err
+		}
+		if queryOptions, err = queryOptions.withHeader(headerRow); err != nil {
+			return nil, err
+		}
+	}
+
+	out := rightIndex{}
+	var estimatedBytes, rows int64
+	err := forEachIndexRow(right, queryOptions, func(line string, offset int64, lineNumber int) error {
+		k, err := attemptSplitAndSelectCol(line, queryOptions)
+		if err != nil {
+			return err
+		}
+		if k == "" {
+			// blank lines can't be joined on and shouldn't be
+			// reported as unmatched either
+			return nil
+		}
+		entry := &indexEntry{offset: offset, length: len(line)}
+		if mode == IndexInMemory {
+			entry.data = line
+			estimatedBytes += int64(len(line))
+		} else {
+			// the key is likely a substring of the line, so copy it
+			// to avoid keeping the entire line around in memory
+			k = string([]byte(k))
+			estimatedBytes += int64(len(k))
+		}
+		estimatedBytes += indexEntryOverhead
+		rows++
+		if maxMemory > 0 && estimatedBytes > maxMemory {
+			return &indexTooLargeError{bytesRead: offset + int64(len(line)), estimatedBytes: estimatedBytes, rows: rows}
+		}
+		return out.add(k, entry, lineNumber, duplicates)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// reads the index file row by row, skipping the header if it has one,
+// and calls fn with each row along with its byte offset and line number.
+// The rows are lines, unless it's JSON which isn't split up by them.
+func forEachIndexRow(path string, q QueryOptions, fn func(line string, offset int64, lineNumber int) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if q.Format == FormatJSON {
+		r, err := newJSONRecordReader(f, q)
+		if err != nil {
+			return err
+		}
+		for {
+			rec, err := r.next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(rec.data, rec.offset, int(rec.line)); err != nil {
+				return err
+			}
+		}
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for i := 0; ; i++ {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+		line = strings.TrimSuffix(line, "\n")
+
+		if i > 0 || !q.Header {
+			if err := fn(line, lineOffset, i+1); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// adds the entry to the index, according to the duplicate key policy
+func (index rightIndex) add(k string, entry *indexEntry, lineNumber int, duplicates DuplicateKeyPolicy) error {
+	existing, found := index[k]
+	if found {
+		// the first entry keeps count, and is replaced for DuplicateKeysLast
+		existing[0].duplicates++
+		entry.duplicates = existing[0].duplicates
+	}
+	switch {
+	case !found || duplicates == DuplicateKeysAll:
+		index[k] = append(existing, entry)
+	case duplicates == DuplicateKeysLast:
+		index[k] = []*indexEntry{entry}
+	case duplicates == DuplicateKeysError:
+		return fmt.Errorf("duplicate key %q found in index file on line %d", k, lineNumber)
+	}
+	return nil
+}
+
+// reads the header of the index file and builds the index, or loads it from a
+// prebuilt index file. The function returned closes the index file, if it's
+// being read from while joining.
+func (j *joiner) loadIndex() (func(), error) {
+	noop := func() {}
+	if j.options.PrebuiltIndex != "" {
+		return j.loadPrebuiltIndex()
+	}
+	if j.options.IndexFile == "" {
+		return noop, nil
+	}
+
+	if j.options.RightQueryOptions.Header {
+		headerRow, err := readIndexFileHeader(j.options.IndexFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read header of index file: %w", err)
+		}
+		j.options.RightQueryOptions, err = j.options.RightQueryOptions.withHeader(headerRow)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse header of index file: %w", err)
+		}
+	}
+	i, err := createIndexMap(j.options.IndexFile, j.options.RightQueryOptions, j.options.DuplicateKeys, j.options.IndexMode, j.options.MaxMemory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+	j.hashIndex = i
+	if j.options.BloomFalsePositiveRate > 0 {
+		j.bloom = newBloomFilterForIndex(i, j.options.BloomFalsePositiveRate)
+	}
+	if j.options.IndexMode == IndexInMemory {
+		return noop, nil
+	}
+	return j.openIndexFile()
+}
+
+func (j *joiner) loadPrebuiltIndex() (func(), error) {
+	p, err := loadIndexFile(j.options.PrebuiltIndex)
+	if err != nil {
+		return nil, err
+	}
+	// the index file can be moved, so allow for the
+	// source to be specified along with the prebuilt index
+	if j.options.IndexFile == "" {
+		j.options.IndexFile = p.Source
+	}
+	if err := p.verifySource(j.options.IndexFile, j.options.VerifyIndexChecksum); err != nil {
+		if !j.options.AllowStaleIndex {
+			return nil, fmt.Errorf("refusing to use prebuilt index %q: %w", j.options.PrebuiltIndex, err)
+		}
+		j.logger.Warn("using a stale prebuilt index, results may be incorrect", "index", j.options.PrebuiltIndex, "error", err.Error())
+	}
+	j.options.RightQueryOptions = p.QueryOptions
+	j.options.DuplicateKeys = p.Duplicates
+	j.hashIndex = p.rightIndex()
+	if j.options.BloomFalsePositiveRate > 0 {
+		j.bloom = p.Bloom
+		if j.bloom == nil {
+			j.bloom = newBloomFilterForIndex(j.hashIndex, j.options.BloomFalsePositiveRate)
+		}
+	}
+	return j.openIndexFile()
+}
+
+func (j *joiner) openIndexFile() (func(), error) {
+	f, err := os.Open(j.options.IndexFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file: %w", err)
+	}
+	j.indexFile = f
+	return func() { f.Close() }, nil
+}
+
+// returns the contents of the index file's row, reading it
+// from the index file if it isn't held in memory
+func (j *joiner) indexRow(e *indexEntry) (string, error) {
+	if j.indexFile == nil {
+		return e.data, nil
+	}
+	buf := make([]byte, e.length)
+	_, err := j.indexFile.ReadAt(buf, e.offset)
+	if err != nil {
+		return "", withCategory(ErrorCategoryIndex, fmt.Errorf("failed to read row from index file at offset %d: %w", e.offset, err))
+	}
+	return string(buf), nil
+}
+
+// once the stream is finished, walks the index and writes out every
+// entry which wasn't matched by any row of the incoming stream, in the
+// order in which they appear in the index file
+func (j *joiner) emitUnmatchedIndexRows() {
+	type unmatchedEntry struct {
+		key   string
+		entry *indexEntry
+	}
+	var unmatched []unmatchedEntry
+	for k, entries := range j.hashIndex {
+		for _, e := range entries {
+			if atomic.LoadInt32(&e.joinCount) == 0 {
+				unmatched = append(unmatched, unmatchedEntry{key: k, entry: e})
+			}
+		}
+	}
+	sort.Slice(unmatched, func(a, b int) bool {
+		return unmatched[a].entry.offset < unmatched[b].entry.offset
+	})
+	for _, u := range unmatched {
+		row, err := j.indexRow(u.entry)
+		if err != nil {
+			j.errors <- err
+			continue
+		}
+		j.writeOutResult(Result{
+			Left: nil,
+			Right: &RightResult{
+				IndexFileResult: j.options.RightQueryOptions.indexFileResult(u.key, row),
+			},
+		}, record{})
+	}
+}
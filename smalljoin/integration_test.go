@@ -2,10 +2,20 @@ package smalljoin
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,6 +34,8 @@ func TestSimpleJoin(t *testing.T) {
 		indexFile      string
 		expectedoutput string
 		Options        Options
+		// whether the bloom filter should have turned away any rows
+		bloomRejects bool
 	}{
 		"A simple plain JSON selection and csv index with inner join": {
 			fileToStream: "internal/testdata/testdata_3",
@@ -90,6 +102,146 @@ func TestSimpleJoin(t *testing.T) {
 {"Left":{"Index":"d","Row":"4,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"d\"}}\""},"Right":null}
 			`,
 		},
+		"A simple plain JSON selection and csv index with right join": {
+			fileToStream: "internal/testdata/testdata_3",
+			Options: Options{
+				Jointype:    JoinTypeRight,
+				Concurrency: 10,
+				IndexFile:   "internal/testdata/index_4",
+				RightQueryOptions: QueryOptions{
+					Separator: ",",
+				},
+				LeftQueryOptions: QueryOptions{
+					Separator:      ",",
+					JsonSubquery:   "data.index",
+					AttemptToClean: true,
+					JoinColumn:     4,
+				},
+			},
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"y","Row":"y"}}}
+{"Left":null,"Right":{"IndexFileResult":{"Index":"z","Row":"z"}}}
+{"Left":{"Index":"a","Row":"1,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"a\"}}\""},"Right":{"IndexFileResult":{"Index":"a","Row":"a"}}}
+{"Left":{"Index":"b","Row":"2,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"b\"}}\""},"Right":{"IndexFileResult":{"Index":"b","Row":"b"}}}
+			`,
+		},
+		"A simple plain JSON selection and csv index with full join": {
+			fileToStream: "internal/testdata/testdata_3",
+			Options: Options{
+				Jointype:    JoinTypeFull,
+				Concurrency: 10,
+				IndexFile:   "internal/testdata/index_4",
+				RightQueryOptions: QueryOptions{
+					Separator: ",",
+				},
+				LeftQueryOptions: QueryOptions{
+					Separator:      ",",
+					JsonSubquery:   "data.index",
+					AttemptToClean: true,
+					JoinColumn:     4,
+				},
+			},
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"y","Row":"y"}}}
+{"Left":null,"Right":{"IndexFileResult":{"Index":"z","Row":"z"}}}
+{"Left":{"Index":"a","Row":"1,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"a\"}}\""},"Right":{"IndexFileResult":{"Index":"a","Row":"a"}}}
+{"Left":{"Index":"b","Row":"2,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"b\"}}\""},"Right":{"IndexFileResult":{"Index":"b","Row":"b"}}}
+{"Left":{"Index":"c","Row":"3,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"c\"}}\""},"Right":null}
+{"Left":{"Index":"d","Row":"4,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"d\"}}\""},"Right":null}
+			`,
+		},
+		"A simple plain JSON selection and csv index with left-is-null join": {
+			fileToStream: "internal/testdata/testdata_3",
+			Options: Options{
+				Jointype:    JoinTypeLeftIsNull,
+				Concurrency: 10,
+				IndexFile:   "internal/testdata/index_4",
+				RightQueryOptions: QueryOptions{
+					Separator: ",",
+				},
+				LeftQueryOptions: QueryOptions{
+					Separator:      ",",
+					JsonSubquery:   "data.index",
+					AttemptToClean: true,
+					JoinColumn:     4,
+				},
+			},
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"y","Row":"y"}}}
+{"Left":null,"Right":{"IndexFileResult":{"Index":"z","Row":"z"}}}
+			`,
+		},
+		"CSV inputs with headers, joined on column names": {
+			fileToStream: "internal/testdata/testdata_5",
+			Options: Options{
+				Jointype:    JoinTypeFull,
+				Concurrency: 10,
+				IndexFile:   "internal/testdata/index_5",
+				RightQueryOptions: QueryOptions{
+					Separator:       ",",
+					Header:          true,
+					JoinColumnNames: []string{"customer_id"},
+				},
+				LeftQueryOptions: QueryOptions{
+					Separator:       ",",
+					Header:          true,
+					JoinColumnNames: []string{"customer_id"},
+				},
+			},
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"c9","Row":"c9,bronze","Fields":{"customer_id":"c9","tier":"bronze"}}}}
+{"Left":{"Index":"c1","Row":"1,alice,c1","Fields":{"customer_id":"c1","id":"1","name":"alice"}},"Right":{"IndexFileResult":{"Index":"c1","Row":"c1,gold","Fields":{"customer_id":"c1","tier":"gold"}}}}
+{"Left":{"Index":"c2","Row":"2,bob,c2","Fields":{"customer_id":"c2","id":"2","name":"bob"}},"Right":null}
+{"Left":{"Index":"c3","Row":"3,carol,c3","Fields":{"customer_id":"c3","id":"3","name":"carol"}},"Right":{"IndexFileResult":{"Index":"c3","Row":"c3,silver","Fields":{"customer_id":"c3","tier":"silver"}}}}
+			`,
+		},
+		"CSV inputs with headers and an on-disk index, joined on column names": {
+			fileToStream: "internal/testdata/testdata_5",
+			Options: Options{
+				Jointype:    JoinTypeRight,
+				Concurrency: 10,
+				IndexFile:   "internal/testdata/index_5",
+				IndexMode:   IndexOnDisk,
+				RightQueryOptions: QueryOptions{
+					Separator:       ",",
+					Header:          true,
+					JoinColumnNames: []string{"customer_id"},
+				},
+				LeftQueryOptions: QueryOptions{
+					Separator:  ",",
+					JoinColumn: 2,
+					Header:     true,
+				},
+			},
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"c9","Row":"c9,bronze","Fields":{"customer_id":"c9","tier":"bronze"}}}}
+{"Left":{"Index":"c1","Row":"1,alice,c1","Fields":{"customer_id":"c1","id":"1","name":"alice"}},"Right":{"IndexFileResult":{"Index":"c1","Row":"c1,gold","Fields":{"customer_id":"c1","tier":"gold"}}}}
+{"Left":{"Index":"c3","Row":"3,carol,c3","Fields":{"customer_id":"c3","id":"3","name":"carol"}},"Right":{"IndexFileResult":{"Index":"c3","Row":"c3,silver","Fields":{"customer_id":"c3","tier":"silver"}}}}
+			`,
+		},
+		"A simple plain JSON selection and csv index with right-is-null join and a bloom filter": {
+			fileToStream: "internal/testdata/testdata_3",
+			Options: Options{
+				Jointype:               JoinTypeRightIsNull,
+				Concurrency:            10,
+				IndexFile:              "internal/testdata/index_4",
+				BloomFalsePositiveRate: 0.01,
+				RightQueryOptions: QueryOptions{
+					Separator: ",",
+				},
+				LeftQueryOptions: QueryOptions{
+					Separator:      ",",
+					JsonSubquery:   "data.index",
+					AttemptToClean: true,
+					JoinColumn:     4,
+				},
+			},
+			expectedoutput: `
+{"Left":{"Index":"c","Row":"3,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"c\"}}\""},"Right":null}
+{"Left":{"Index":"d","Row":"4,col1,col2,\"test\",\"{\\\"data\\\": {\\\"index\\\":\\\"d\"}}\""},"Right":null}
+			`,
+			bloomRejects: true,
+		},
 	}
 
 	for name, td := range tests {
@@ -108,6 +260,9 @@ func TestSimpleJoin(t *testing.T) {
 			assert.NoError(t, err, name)
 
 			sortAndCompare(t, td.expectedoutput, outStream.Bytes())
+			if td.bloomRejects {
+				assert.Greater(t, j.(*joiner).bloomStats.rejected, int64(0), name)
+			}
 		})
 	}
 }
@@ -122,3 +277,520 @@ func sortAndCompare(t *testing.T, expected string, out []byte) {
 
 	assert.Equal(t, strings.Trim(expected, cutset), strings.Trim(string(outSorted), cutset))
 }
+
+func TestPreserveOrder(t *testing.T) {
+	var input strings.Builder
+	var expected strings.Builder
+	for i := 0; i < 20000; i++ {
+		row := fmt.Sprintf("row-%d", i)
+		input.WriteString(row + "\n")
+		expected.WriteString(Result{Left: &LeftResult{Index: row, Row: row}}.String() + "\n")
+	}
+
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	j := New(ioutil.NopCloser(strings.NewReader(input.String())), outStream, errStream, Options{
+		Jointype:      JoinTypeLeft,
+		Concurrency:   10,
+		IndexFile:     "internal/testdata/index_4",
+		PreserveOrder: true,
+		LeftQueryOptions: QueryOptions{
+			JoinColumn: -1,
+		},
+		RightQueryOptions: QueryOptions{
+			JoinColumn: -1,
+		},
+	})
+	err := j.Run()
+	assert.NoError(t, err)
+	// not sorted, the output should be in the same order as the input
+	assert.Equal(t, expected.String(), outStream.String())
+}
+
+// gives a line with each read, and then waits to be closed
+type slowLinesReader struct {
+	lines  []string
+	read   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (r *slowLinesReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		close(r.read)
+		<-r.closed
+		return 0, io.EOF
+	}
+	n := copy(p, r.lines[0])
+	r.lines = r.lines[1:]
+	return n, nil
+}
+
+func (r *slowLinesReader) Close() error {
+	r.once.Do(func() { close(r.closed) })
+	return nil
+}
+
+func TestInterruptJoinsTheRowsAlreadyRead(t *testing.T) {
+	input := &slowLinesReader{lines: []string{"a\n", "b\n", "c\n", "d\n", "e\n"}, read: make(chan struct{}), closed: make(chan struct{})}
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	j := New(input, outStream, createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		Jointype: JoinTypeInner,
+		// slow enough that the rows are queued up waiting for the worker
+		RightExecStr:       "sleep 0.05",
+		Concurrency:        1,
+		IncomingBufferSize: 10,
+		PreserveOrder:      true,
+		LeftQueryOptions:   QueryOptions{JoinColumn: -1},
+		RightQueryOptions:  QueryOptions{JoinColumn: -1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- j.RunContext(ctx)
+	}()
+	<-input.read
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	// every row which was read is joined, rather than dropped
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(outStream.String()), "\n") {
+		var res Result
+		assert.NoError(t, json.Unmarshal([]byte(line), &res))
+		keys = append(keys, res.Left.Index)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+	assert.Equal(t, int64(5), j.Stats().Matched)
+}
+
+func TestRunContextCancellation(t *testing.T) {
+	// the stream never finishes, so only cancelling will stop the join
+	input, inputWriter := io.Pipe()
+	go func() {
+		for {
+			if _, err := inputWriter.Write([]byte("a\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	j := New(input, outStream, errStream, Options{
+		Jointype:  JoinTypeInner,
+		IndexFile: "internal/testdata/index_4",
+		LeftQueryOptions: QueryOptions{
+			JoinColumn: -1,
+		},
+		RightQueryOptions: QueryOptions{
+			JoinColumn: -1,
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- j.RunContext(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the join didn't stop after being cancelled")
+	}
+	// the last offset is only ever at the end of a row which has been joined
+	stats := j.Stats()
+	assert.True(t, stats.LastOffset%2 == 0 && stats.LastOffset <= 2*stats.LinesRead, "stats: %+v", stats)
+	assert.Equal(t, stats.LinesRead, stats.Matched)
+
+	// everything which was written out should be complete
+	for _, line := range strings.Split(strings.TrimSpace(outStream.String()), "\n") {
+		assert.Equal(t, `{"Left":{"Index":"a","Row":"a"},"Right":{"IndexFileResult":{"Index":"a","Row":"a"}}}`, line)
+	}
+}
+
+func TestRowErrors(t *testing.T) {
+	input := "{\"id\":\"a\"}\nnot json\n{\"id\":\"b\"}\n"
+	tests := map[string]struct {
+		continueOnErr  bool
+		expectedOutput string
+		expectedErr    bool
+	}{
+		"the first bad row stops the join": {
+			expectedErr: true,
+		},
+		"bad rows are skipped with ContinueOnErr": {
+			continueOnErr: true,
+			expectedOutput: `
+{"Left":{"Index":"a","Row":"{\"id\":\"a\"}"},"Right":{"IndexFileResult":{"Index":"a","Row":"a"}}}
+{"Left":{"Index":"b","Row":"{\"id\":\"b\"}"},"Right":{"IndexFileResult":{"Index":"b","Row":"b"}}}
+			`,
+		},
+	}
+
+	for name, td := range tests {
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		j := New(ioutil.NopCloser(strings.NewReader(input)), outStream, errStream, Options{
+			Jointype:      JoinTypeInner,
+			IndexFile:     "internal/testdata/index_4",
+			ContinueOnErr: td.continueOnErr,
+			Concurrency:   1,
+			LeftQueryOptions: QueryOptions{
+				JoinColumn:   -1,
+				JsonSubquery: "id",
+			},
+			RightQueryOptions: QueryOptions{
+				JoinColumn: -1,
+			},
+		})
+		err := j.Run()
+		if !td.expectedErr {
+			assert.NoError(t, err, name)
+			assert.Contains(t, errStream.String(), "line=2 offset=11 category=json", name)
+			sortAndCompare(t, td.expectedOutput, outStream.Bytes())
+			stats := j.Stats()
+			stats.Elapsed = 0
+			assert.Equal(t, Stats{
+				LinesRead:        3,
+				Matched:          2,
+				Errored:          1,
+				ErrorsByCategory: map[string]int64{ErrorCategoryJSON: 1},
+				DistinctKeys:     2,
+				LastOffset:       int64(len(input)),
+				IndexKeys:        4,
+				IndexRows:        4,
+			}, stats, name)
+			continue
+		}
+		var rowErr *RowError
+		if assert.True(t, errors.As(err, &rowErr), name) {
+			assert.Equal(t, int64(2), rowErr.Line, name)
+			assert.Equal(t, int64(11), rowErr.Offset, name)
+			assert.Equal(t, "not json", rowErr.Row, name)
+		}
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	input := "{\"id\":\"a\"}\nbad 1\nbad 2\n{\"id\":\"b\"}\nbad 3\n"
+	budget := func(n int64) *int64 { return &n }
+	tests := map[string]struct {
+		maxErrors       *int64
+		maxErrorRate    float64
+		expectExceeded  bool
+		expectedRejects int
+	}{
+		"within the max errors": {
+			maxErrors:       budget(3),
+			expectedRejects: 3,
+		},
+		"over the max errors": {
+			maxErrors:       budget(2),
+			expectExceeded:  true,
+			expectedRejects: 3,
+		},
+		// the rows which were already joined are still rejected
+		"a budget of no rows": {
+			maxErrors:       budget(0),
+			expectExceeded:  true,
+			expectedRejects: 3,
+		},
+		"no rows on top of a max error rate": {
+			maxErrors:       budget(0),
+			maxErrorRate:    0.7,
+			expectExceeded:  true,
+			expectedRejects: 3,
+		},
+		"within the max error rate": {
+			maxErrorRate:    0.7,
+			expectedRejects: 3,
+		},
+		"over the max error rate, which is checked at the end": {
+			maxErrorRate:    0.5,
+			expectExceeded:  true,
+			expectedRejects: 3,
+		},
+	}
+
+	for name, td := range tests {
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		rejects := bytes.NewBuffer(nil)
+		j := New(ioutil.NopCloser(strings.NewReader(input)), outStream, errStream, Options{
+			Jointype:     JoinTypeInner,
+			IndexFile:    "internal/testdata/index_4",
+			Concurrency:  1,
+			MaxErrors:    td.maxErrors,
+			MaxErrorRate: td.maxErrorRate,
+			Rejects:      rejects,
+			LeftQueryOptions: QueryOptions{
+				JoinColumn:   -1,
+				JsonSubquery: "id",
+			},
+			RightQueryOptions: QueryOptions{
+				JoinColumn: -1,
+			},
+		})
+		err := j.Run()
+		var exceeded *ErrorBudgetExceeded
+		assert.Equal(t, td.expectExceeded, errors.As(err, &exceeded), "%s: %v", name, err)
+		if !td.expectExceeded {
+			assert.NoError(t, err, name)
+		}
+
+		rejected := strings.Split(strings.TrimSpace(rejects.String()), "\n")
+		assert.Len(t, rejected, td.expectedRejects, name)
+		var first rejectedRow
+		assert.NoError(t, json.Unmarshal([]byte(rejected[0]), &first), name)
+		assert.Equal(t, rejectedRow{Line: 2, Offset: 11, Row: "bad 1", Error: first.Error}, first, name)
+		assert.NotEmpty(t, first.Error, name)
+	}
+}
+
+func TestInvalidErrorBudget(t *testing.T) {
+	negative := int64(-1)
+	tests := map[string]struct {
+		maxErrors    *int64
+		maxErrorRate float64
+		expectedErr  string
+	}{
+		"negative max errors":       {maxErrors: &negative, expectedErr: "not a valid max errors -1, it needs to be 0 or more"},
+		"negative max error rate":   {maxErrorRate: -5, expectedErr: "not a valid max error rate -5, it needs to be between 0 and 1"},
+		"max error rate over one":   {maxErrorRate: 1.5, expectedErr: "not a valid max error rate 1.5, it needs to be between 0 and 1"},
+		"max error rate that's NaN": {maxErrorRate: math.NaN(), expectedErr: "not a valid max error rate NaN, it needs to be between 0 and 1"},
+	}
+	for name, td := range tests {
+		j := New(ioutil.NopCloser(strings.NewReader("a\n")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+			Jointype:          JoinTypeInner,
+			IndexFile:         "internal/testdata/index_4",
+			MaxErrors:         td.maxErrors,
+			MaxErrorRate:      td.maxErrorRate,
+			LeftQueryOptions:  QueryOptions{JoinColumn: -1},
+			RightQueryOptions: QueryOptions{JoinColumn: -1},
+		})
+		assert.EqualError(t, j.Run(), td.expectedErr, name)
+	}
+}
+
+func TestInvalidJoinOptions(t *testing.T) {
+	tests := map[string]struct {
+		options     Options
+		expectedErr string
+	}{
+		"no options": {
+			expectedErr: "the right side of the join is required: an index file, a prebuilt index or a command to run",
+		},
+		"not a join type": {
+			options:     Options{Jointype: 42, IndexFile: "internal/testdata/index_4"},
+			expectedErr: "not a valid join type 42",
+		},
+	}
+	for name, td := range tests {
+		j := New(ioutil.NopCloser(strings.NewReader("a\n")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), td.options)
+		assert.EqualError(t, j.Run(), td.expectedErr, name)
+	}
+}
+
+func TestStats(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte("a\na\nb\nc\n"), 0644))
+	input := "\na\nb\nb\nx\n"
+
+	tests := map[string]Options{
+		"hash join":       {IndexFile: indexFile},
+		"merge join":      {IndexFile: indexFile, SortedInputs: true},
+		"grace hash join": {IndexFile: indexFile, MaxMemory: 1},
+		// a command which fails isn't a match
+		"exec": {RightExecStr: "test {} != x"},
+	}
+	for name, o := range tests {
+		o.Jointype = JoinTypeInner
+		o.LeftQueryOptions = QueryOptions{JoinColumn: -1}
+		o.RightQueryOptions = QueryOptions{JoinColumn: -1}
+		j := New(ioutil.NopCloser(strings.NewReader(input)), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), o)
+		assert.NoError(t, j.Run(), name)
+
+		stats := j.Stats()
+		assert.True(t, stats.Elapsed > 0, name)
+		stats.Elapsed = 0
+		expected := Stats{
+			LinesRead:    5,
+			EmptyKey:     1,
+			Matched:      3,
+			Unmatched:    1,
+			DistinctKeys: 3,
+			LastOffset:   int64(len(input)),
+		}
+		if o.IndexFile != "" {
+			expected.IndexKeys, expected.IndexRows, expected.DuplicateIndexKeys = 3, 4, 1
+		}
+		assert.Equal(t, expected, stats, name)
+	}
+}
+
+func TestMultilineCSVRecords(t *testing.T) {
+	var input, index, expected strings.Builder
+	for i := 0; i < 2000; i++ {
+		// enough rows for records to straddle the reads of the incoming stream
+		row := fmt.Sprintf("k%d,\"a note\nspread over \"\"lines\"\",\nwith commas\",end", i)
+		input.WriteString(row + "\n")
+		index.WriteString(fmt.Sprintf("k%d\n", i))
+		key := fmt.Sprintf("k%d", i)
+		expected.WriteString(Result{
+			Left:  &LeftResult{Index: key, Row: row},
+			Right: &RightResult{IndexFileResult: &IndexFileResult{Index: key, Row: key}},
+		}.String() + "\n")
+	}
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte(index.String()), 0644))
+
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	j := New(ioutil.NopCloser(strings.NewReader(input.String())), outStream, createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		Jointype:          JoinTypeInner,
+		IndexFile:         indexFile,
+		PreserveOrder:     true,
+		LeftQueryOptions:  QueryOptions{Separator: ",", JoinColumn: 0},
+		RightQueryOptions: QueryOptions{JoinColumn: -1},
+	})
+	assert.NoError(t, j.Run())
+	assert.Equal(t, expected.String(), outStream.String())
+	assert.Equal(t, int64(2000), j.Stats().Matched)
+	assert.Equal(t, int64(0), j.Stats().Errored)
+}
+
+func TestCSVDialects(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte("# keys\na\\|1|x\n'b|2'|y\n"), 0644))
+	input := "-- exported\n\"a|1\",\"it's \\\"here\\\"\"\n\"b|2\",\"multi\nline\"\n"
+
+	dialect := CSVDialect{Escape: EscapeBackslash, Comment: "-- "}
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	j := New(ioutil.NopCloser(strings.NewReader(input)), outStream, createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		Jointype:          JoinTypeInner,
+		IndexFile:         indexFile,
+		PreserveOrder:     true,
+		LeftQueryOptions:  QueryOptions{Separator: ",", JoinColumn: 0, Dialect: dialect},
+		RightQueryOptions: QueryOptions{Separator: "|", JoinColumn: 0, Dialect: CSVDialect{Quote: '\'', Escape: EscapeBackslash, Comment: "#"}},
+	})
+	assert.NoError(t, j.Run())
+	assert.Equal(t, Result{
+		Left:  &LeftResult{Index: "a|1", Row: "\"a|1\",\"it's \\\"here\\\"\""},
+		Right: &RightResult{IndexFileResult: &IndexFileResult{Index: "a|1", Row: "a\\|1|x"}},
+	}.String()+"\n"+Result{
+		Left:  &LeftResult{Index: "b|2", Row: "\"b|2\",\"multi\nline\""},
+		Right: &RightResult{IndexFileResult: &IndexFileResult{Index: "b|2", Row: "'b|2'|y"}},
+	}.String()+"\n", outStream.String())
+
+	stats := j.Stats()
+	assert.Equal(t, int64(2), stats.LinesRead)
+	assert.Equal(t, int64(2), stats.IndexRows)
+}
+
+func TestNDJSON(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte(`{"user":{"id":1},"tenant":"a","plan":"free"}
+{"user":{"id":2},"tenant":"a","plan":"paid"}
+`), 0644))
+	input := `{"tenant":"a","user_id":1,"event":"login, \"first\""}
+{"tenant":"a","user_id":2,"event":"logout"}
+{"tenant":"b","user_id":1,"event":"login"}
+`
+	expected := `{"Left":{"Index":"[\"a\",\"1\"]","Row":{"tenant":"a","user_id":1,"event":"login, \"first\""}},"Right":{"IndexFileResult":{"Index":"[\"a\",\"1\"]","Row":{"user":{"id":1},"tenant":"a","plan":"free"}}}}
+{"Left":{"Index":"[\"a\",\"2\"]","Row":{"tenant":"a","user_id":2,"event":"logout"}},"Right":{"IndexFileResult":{"Index":"[\"a\",\"2\"]","Row":{"user":{"id":2},"tenant":"a","plan":"paid"}}}}
+`
+
+	tests := map[string]Options{
+		"hash join":       {PreserveOrder: true},
+		"merge join":      {SortedInputs: true},
+		"grace hash join": {MaxMemory: 1, Concurrency: 1},
+	}
+	for name, o := range tests {
+		o.IndexFile = indexFile
+		o.Jointype = JoinTypeInner
+		o.LeftQueryOptions = QueryOptions{Format: FormatNDJSON, JoinColumn: -1, JsonSubqueries: []string{"tenant", "user_id"}}
+		o.RightQueryOptions = QueryOptions{Format: FormatNDJSON, JoinColumn: -1, JsonSubqueries: []string{"tenant", "user.id"}}
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		j := New(ioutil.NopCloser(strings.NewReader(input)), outStream, createNoopWriteCloser(bytes.NewBuffer(nil)), o)
+		assert.NoError(t, j.Run(), name)
+		sortAndCompare(t, expected, outStream.Bytes())
+	}
+}
+
+func TestJSONInput(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte(`{
+  "data": {
+    "users": [
+      {"id": 1, "plan": "free"},
+      {
+        "id": 2,
+        "plan": "paid"
+      }
+    ]
+  }
+}
+{"data": {"users": [{"id": 3, "plan": "paid"}]}}
+`), 0644))
+	input := `[
+  {"user_id": 1, "event": "login"},
+  {
+    "user_id": 2,
+    "event": "logout"
+  },
+  {"user_id": 4, "event": "login"}
+]`
+	expected := `{"Left":{"Index":"1","Row":{"user_id":1,"event":"login"}},"Right":{"IndexFileResult":{"Index":"1","Row":{"id":1,"plan":"free"}}}}
+{"Left":{"Index":"2","Row":{"user_id":2,"event":"logout"}},"Right":{"IndexFileResult":{"Index":"2","Row":{"id":2,"plan":"paid"}}}}
+`
+
+	tests := map[string]Options{
+		"hash join":          {PreserveOrder: true},
+		"index held on disk": {IndexMode: IndexOnDisk},
+		"merge join":         {SortedInputs: true},
+		"grace hash join":    {MaxMemory: 1, Concurrency: 1},
+	}
+	for name, o := range tests {
+		o.IndexFile = indexFile
+		o.Jointype = JoinTypeInner
+		o.LeftQueryOptions = QueryOptions{Format: FormatJSON, JoinColumn: -1, JsonSubquery: "user_id"}
+		o.RightQueryOptions = QueryOptions{Format: FormatJSON, JoinColumn: -1, JsonSubquery: "id", JSONArrayPath: "data.users"}
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		j := New(ioutil.NopCloser(strings.NewReader(input)), outStream, createNoopWriteCloser(bytes.NewBuffer(nil)), o)
+		assert.NoError(t, j.Run(), name)
+		sortAndCompare(t, expected, outStream.Bytes())
+		assert.Equal(t, int64(3), j.Stats().LinesRead, name)
+	}
+
+	// there's nowhere in the middle of an array to resume reading from
+	j := New(ioutil.NopCloser(strings.NewReader(input)), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		IndexFile:         indexFile,
+		Checkpoint:        filepath.Join(t.TempDir(), "checkpoint"),
+		LeftQueryOptions:  QueryOptions{Format: FormatJSON, JoinColumn: -1, JsonSubquery: "user_id"},
+		RightQueryOptions: QueryOptions{Format: FormatJSON, JoinColumn: -1, JsonSubquery: "id", JSONArrayPath: "data.users"},
+	})
+	assert.Error(t, j.Run())
+}
+
+func TestNDJSONValidation(t *testing.T) {
+	tests := map[string]QueryOptions{
+		"no subquery":                           {Format: FormatNDJSON, JoinColumn: -1},
+		"a join column":                         {Format: FormatNDJSON, JoinColumn: 2, JsonSubquery: "id"},
+		"a header":                              {Format: FormatNDJSON, JoinColumn: -1, JsonSubquery: "id", Header: true},
+		"an array path for ndjson":              {Format: FormatNDJSON, JoinColumn: -1, JsonSubquery: "id", JSONArrayPath: "items"},
+		"an array path which can't be streamed": {Format: FormatJSON, JoinColumn: -1, JsonSubquery: "id", JSONArrayPath: "items[0].children"},
+	}
+	for name, q := range tests {
+		j := New(ioutil.NopCloser(strings.NewReader("")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+			IndexFile:         "internal/testdata/index_4",
+			LeftQueryOptions:  q,
+			RightQueryOptions: QueryOptions{JoinColumn: -1},
+		})
+		assert.Error(t, j.Run(), name)
+	}
+}
@@ -1,7 +1,6 @@
 package smalljoin
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,54 +12,78 @@ import (
 	"github.com/jmespath/go-jmespath"
 )
 
-// matches \"
-var slashEscapeForQuotesRE = regexp.MustCompile(`\\\"`)
 var doubleQuotes = regexp.MustCompile(`""`)
 
 // Join is the main function which takes a string line from the input
 // and attempts to match it against the index according to whatever settings
-// are configured.
-func (j *joiner) join(leftjoinRow string) (*Result, error) {
+// are configured. Several results are returned when the index file
+// contains more than one row for the matched key.
+func (j *joiner) join(leftjoinRow string) ([]Result, error) {
 	if j.options.IndexFile != "" {
 		return j.joinIndexFile(leftjoinRow)
 	}
 	if j.options.RightExecStr != "" {
-		return j.joinExecStr(leftjoinRow)
+		res, err := j.joinExecStr(leftjoinRow)
+		if err != nil {
+			return nil, err
+		}
+		return []Result{*res}, nil
 	}
-	panic("no configured joining options")
+	return nil, fmt.Errorf("no configured joining options")
 }
 
-func (j *joiner) joinIndexFile(leftjoinRow string) (*Result, error) {
+func (j *joiner) joinIndexFile(leftjoinRow string) ([]Result, error) {
 	leftJoinCell, err := attemptSplitAndSelectCol(leftjoinRow, j.options.LeftQueryOptions)
 	if err != nil {
 		return nil, err
 	}
 	if leftJoinCell == "" {
-		return &Result{}, nil
+		return []Result{{}}, nil
+	}
+	return j.lookupIndex(leftjoinRow, leftJoinCell)
+}
+
+// finds the rows in the index matching the key of the left row
+func (j *joiner) lookupIndex(leftjoinRow string, leftJoinCell string) ([]Result, error) {
+	var rights []*indexEntry
+	ok := false
+	if j.bloom == nil || j.bloomMayContain(leftJoinCell) {
+		rights, ok = j.hashIndex[leftJoinCell]
+		if !ok && j.bloom != nil {
+			atomic.AddInt64(&j.bloomStats.falsePositives, 1)
+		}
+	}
+	left := j.options.LeftQueryOptions.leftResult(leftJoinCell, leftjoinRow)
+	if !ok {
+		return []Result{{
+			Left:  left,
+			Right: nil,
+		}}, nil
 	}
-	right, ok := j.hashIndex[leftJoinCell]
-	if ok {
+	out := make([]Result, 0, len(rights))
+	for _, right := range rights {
 		atomic.AddInt32(&right.joinCount, 1)
-		return &Result{
-			Left: &LeftResult{
-				Row:   leftjoinRow,
-				Index: leftJoinCell,
-			},
+		rightRow, err := j.indexRow(right)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Result{
+			Left: left,
 			Right: &RightResult{
-				IndexFileResult: &IndexFileResult{
-					Index: leftJoinCell,
-					Row:   right.data,
-				},
+				IndexFileResult: j.options.RightQueryOptions.indexFileResult(leftJoinCell, rightRow),
 			},
-		}, nil
+		})
 	}
-	return &Result{
-		Left: &LeftResult{
-			Index: leftJoinCell,
-			Row:   leftjoinRow,
-		},
-		Right: nil,
-	}, nil
+	return out, nil
+}
+
+func (j *joiner) bloomMayContain(key string) bool {
+	atomic.AddInt64(&j.bloomStats.checks, 1)
+	if j.bloom.mayContain(key) {
+		return true
+	}
+	atomic.AddInt64(&j.bloomStats.rejected, 1)
+	return false
 }
 
 func (j *joiner) joinExecStr(leftjoinRow string) (*Result, error) {
@@ -72,8 +95,11 @@ func (j *joiner) joinExecStr(leftjoinRow string) (*Result, error) {
 		return &Result{}, nil
 	}
 
+	left := j.options.LeftQueryOptions.leftResult(leftJoinCell, leftjoinRow)
 	cmd := exec.Command("bash", "-c", strings.ReplaceAll(j.options.RightExecStr, "{}", leftJoinCell))
+	start := j.metrics.execLatency.start()
 	stdout, err := cmd.CombinedOutput()
+	j.metrics.execLatency.observeSince(start)
 	stdOutStr := string(stdout)
 	if err != nil {
 		var e *exec.ExitError
@@ -81,10 +107,7 @@ func (j *joiner) joinExecStr(leftjoinRow string) (*Result, error) {
 			code := e.ProcessState.ExitCode()
 			stdErrStr := string(e.Stderr)
 			return &Result{
-				Left: &LeftResult{
-					Index: leftJoinCell,
-					Row:   leftjoinRow,
-				},
+				Left: left,
 				Right: &RightResult{
 					ExecResult: &ExecResult{
 						ExecStdout: stdOutStr,
@@ -100,10 +123,7 @@ func (j *joiner) joinExecStr(leftjoinRow string) (*Result, error) {
 
 	exitCode := 0
 	return &Result{
-		Left: &LeftResult{
-			Index: leftJoinCell,
-			Row:   leftjoinRow,
-		},
+		Left: left,
 		Right: &RightResult{
 			ExecResult: &ExecResult{
 				ExecStdout: stdOutStr,
@@ -129,16 +149,21 @@ func searchJSONWithQuery(jsonData string, options QueryOptions) (string, error)
 		err = json.Unmarshal([]byte(attempt2), &data)
 		if err != nil {
 			// not recoverable,
-			return "", fmt.Errorf("failure to deserialize JSON, %v. Data %v", err, jsonData)
+			return "", withCategory(ErrorCategoryJSON, fmt.Errorf("failure to deserialize JSON, %v. Data %v", err, jsonData))
 		}
 	}
 	if err != nil && !options.AttemptToClean {
-		return "", fmt.Errorf("failure to deserialize JSON, %v. Data %v", err, jsonData)
+		return "", withCategory(ErrorCategoryJSON, fmt.Errorf("failure to deserialize JSON, %v. Data %v", err, jsonData))
 	}
 
-	result, err := jmespath.Search(options.JsonSubquery, data)
+	return queryJSONKey(data, options.JsonSubquery)
+}
+
+// queries into JSON which has already been decoded, for part of a key
+func queryJSONKey(data interface{}, query string) (string, error) {
+	result, err := jmespath.Search(query, data)
 	if err != nil {
-		return "", err
+		return "", withCategory(ErrorCategoryKey, err)
 	}
 	switch v := result.(type) {
 	case nil:
@@ -148,61 +173,108 @@ func searchJSONWithQuery(jsonData string, options QueryOptions) (string, error)
 	case string:
 		return v, nil
 	default:
-		return "", fmt.Errorf("JMESpath query did not return a primitive type, this can't be joined on. Got: %v, type %T", v, v)
+		return "", withCategory(ErrorCategoryKey, fmt.Errorf("JMESpath query did not return a primitive type, this can't be joined on. Got: %v, type %T", v, v))
 	}
 }
 
+// attempts to find the join key for the row according to the query options.
+// Composite keys (several columns or queries) are returned as a JSON array of
+// their parts, such as `["tenant-1","user-2"]`, so they can be compared as a
+// single string. If any part of a composite key is empty the whole key is
+// treated as empty, ie, it won't be joined on.
 func attemptSplitAndSelectCol(row string, options QueryOptions) (string, error) {
 
-	if strings.TrimSpace(row) == "" {
+	if strings.TrimSpace(row) == "" || options.csvRules().isComment(row) {
 		return "", nil
 	}
 
-	if options.JoinColumn < 0 && options.JsonSubquery == "" {
-		return row, nil // if we're joining on the whole row, don't bother splitting
+	if options.Format != FormatDelimited {
+		return selectNDJSONKey(row, options)
 	}
-	if options.JoinColumn < 0 && options.JsonSubquery != "" {
-		return searchJSONWithQuery(row, options)
+
+	extractors, err := options.keyExtractors()
+	if err != nil {
+		return "", err
 	}
-	var joinCell string
 
-	// csv split using CSV parser
-	if options.Separator == "," {
-		// this a hack for nonstandard CSVs using slash quotes instead of double quotes for CSV
-		// and is a very ugly way of solving the fact the golang CSV parser doesn't appear
-		// to allow for any configurability here to provide alternate escapes
-		if options.AttemptToClean {
-			row = slashEscapeForQuotesRE.ReplaceAllString(row, `""`)
+	var columns []string
+	for _, e := range extractors {
+		if e.column >= 0 {
+			columns, err = splitColumns(row, options)
+			if err != nil {
+				return "", err
+			}
+			break
 		}
-		csvParser := csv.NewReader(strings.NewReader(row))
-		csvParser.LazyQuotes = true
-		res, err := csvParser.ReadAll()
+	}
 
+	parts := make([]string, 0, len(extractors))
+	for _, e := range extractors {
+		part, err := selectKeyPart(row, columns, e, options)
 		if err != nil {
-			return "", fmt.Errorf("failure to parse CSV: %v. Data %v", err, row)
-		}
-		if len(res) < 1 {
-			return "", fmt.Errorf("failure to parse CSV, couldn't find any rows to parse correctly")
+			return "", err
 		}
-		if len(res) > 1 {
-			return "", fmt.Errorf("failure to parse CSV, found more than a single row to parse")
-		}
-		if len(res[0])-1 < options.JoinColumn {
-			return "", fmt.Errorf("failure to parse CSV and fetch column %v, only found %v columns. Data: %v",
-				options.JoinColumn, len(res[0]), row)
+		parts = append(parts, part)
+	}
+	return combineKeyParts(parts)
+}
+
+// makes a key out of its parts, which for a composite
+// key is a JSON array of them, unless any are empty
+func combineKeyParts(parts []string) (string, error) {
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", nil
 		}
-		joinCell = res[0][options.JoinColumn]
-	} else { // not using CSV split, so just do a string split
-		split := strings.Split(row, options.Separator)
-		if len(split)-1 < options.JoinColumn {
-			return "", fmt.Errorf("couldn't split row with separator %s and get '%v'th column. Only %d columns found. Remember this is zero-based index. \n\nRow contents: %s", options.Separator, options.JoinColumn, len(split), row)
+	}
+	key, err := json.Marshal(parts)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func selectKeyPart(row string, columns []string, e keyExtractor, options QueryOptions) (string, error) {
+	options.JsonSubquery = e.jsonSubquery
+
+	if e.column < 0 && e.jsonSubquery == "" {
+		return row, nil // if we're joining on the whole row, don't bother splitting
+	}
+	if e.column < 0 && e.jsonSubquery != "" {
+		return searchJSONWithQuery(row, options)
+	}
+
+	if len(columns)-1 < e.column {
+		if options.Separator == "," {
+			return "", withCategory(ErrorCategoryColumn, fmt.Errorf("failure to parse CSV and fetch column %v, only found %v columns. Data: %v",
+				e.column, len(columns), row))
 		}
-		joinCell = split[options.JoinColumn]
+		return "", withCategory(ErrorCategoryColumn, fmt.Errorf("couldn't split row with separator %s and get '%v'th column. Only %d columns found. Remember this is zero-based index. \n\nRow contents: %s", options.Separator, e.column, len(columns), row))
 	}
+	joinCell := columns[e.column]
+
 	// no json involved, simple text case
-	if options.JsonSubquery == "" {
+	if e.jsonSubquery == "" {
 		return strings.TrimSpace(joinCell), nil
 	}
 
 	return searchJSONWithQuery(joinCell, options)
 }
+
+// splits the row up into its columns, using a CSV parser
+// if the separator is a comma
+func splitColumns(row string, options QueryOptions) ([]string, error) {
+	// not using CSV split, so just do a string split
+	if !options.csvColumns() {
+		return strings.Split(row, options.Separator), nil
+	}
+
+	columns, err := options.csvRules().split(row)
+	if err != nil {
+		return nil, withCategory(ErrorCategoryCSV, fmt.Errorf("failure to parse CSV: %v. Data %v", err, row))
+	}
+	return columns, nil
+}
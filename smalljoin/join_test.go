@@ -2,6 +2,8 @@ package smalljoin
 
 import (
 	"errors"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,19 +14,25 @@ func TestJoin(t *testing.T) {
 	var leftSample = `{"data": "key-1"}`
 	var leftSample2 = `{"data": "key-2"}`
 
+	var leftSample3 = `{"data": "key-3"}`
+
 	var rightSample = `right-join-data`
-	index := rightIndex{"key-1": indexEntry{data: rightSample}}
+	var rightSample2 = `more-right-join-data`
+	index := rightIndex{
+		"key-1": {&indexEntry{data: rightSample}},
+		"key-3": {&indexEntry{data: rightSample}, &indexEntry{data: rightSample2}},
+	}
 
 	tests := map[string]struct {
 		input         string
 		jsonQuery     string
-		expectedValue *Result
+		expectedValue []Result
 		expectedErr   error
 	}{
 		"found value with string": {
 			input:     leftSample,
 			jsonQuery: "data",
-			expectedValue: &Result{
+			expectedValue: []Result{{
 				Left: &LeftResult{
 					Index: "key-1",
 					Row:   leftSample,
@@ -35,18 +43,45 @@ func TestJoin(t *testing.T) {
 						Row:   rightSample,
 					},
 				},
-			},
+			}},
 		},
 		"value not present": {
 			input:     leftSample2,
 			jsonQuery: "data",
-			expectedValue: &Result{
+			expectedValue: []Result{{
 				Left: &LeftResult{
 					Index: "key-2",
 					Row:   leftSample2,
 				},
 				Right: nil,
-			},
+			}},
+		},
+		"value present several times in the index": {
+			input:     leftSample3,
+			jsonQuery: "data",
+			expectedValue: []Result{{
+				Left: &LeftResult{
+					Index: "key-3",
+					Row:   leftSample3,
+				},
+				Right: &RightResult{
+					IndexFileResult: &IndexFileResult{
+						Index: "key-3",
+						Row:   rightSample,
+					},
+				},
+			}, {
+				Left: &LeftResult{
+					Index: "key-3",
+					Row:   leftSample3,
+				},
+				Right: &RightResult{
+					IndexFileResult: &IndexFileResult{
+						Index: "key-3",
+						Row:   rightSample2,
+					},
+				},
+			}},
 		},
 	}
 
@@ -70,6 +105,76 @@ func TestJoin(t *testing.T) {
 	}
 }
 
+func TestJoinCountIsTracked(t *testing.T) {
+	index := rightIndex{
+		"key-1": {&indexEntry{data: "right-1"}},
+		"key-2": {&indexEntry{data: "right-2"}},
+	}
+	j := joiner{
+		hashIndex: index,
+		options: Options{
+			IndexFile: "some file",
+			LeftQueryOptions: QueryOptions{
+				JsonSubquery: "data",
+				JoinColumn:   -1,
+			},
+		},
+	}
+	for _, row := range []string{`{"data": "key-1"}`, `{"data": "key-1"}`, `{"data": "key-3"}`} {
+		_, err := j.join(row)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), index["key-1"][0].joinCount)
+	assert.Equal(t, int32(0), index["key-2"][0].joinCount)
+}
+
+func TestCreateIndexMapDuplicates(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	err := ioutil.WriteFile(indexFile, []byte("a,1\nb,2\na,3\n"), 0644)
+	assert.NoError(t, err)
+
+	queryOptions := QueryOptions{Separator: ",", JoinColumn: 0}
+
+	tests := map[string]struct {
+		policy       DuplicateKeyPolicy
+		expectedRows []string
+		expectedErr  error
+	}{
+		"all rows are kept": {
+			policy:       DuplicateKeysAll,
+			expectedRows: []string{"a,1", "a,3"},
+		},
+		"first row is kept": {
+			policy:       DuplicateKeysFirst,
+			expectedRows: []string{"a,1"},
+		},
+		"last row is kept": {
+			policy:       DuplicateKeysLast,
+			expectedRows: []string{"a,3"},
+		},
+		"duplicates are an error": {
+			policy:      DuplicateKeysError,
+			expectedErr: errors.New(`duplicate key "a" found in index file on line 3`),
+		},
+	}
+
+	for name, td := range tests {
+		t.Run(name, func(t *testing.T) {
+			index, err := createIndexMap(indexFile, queryOptions, td.policy, IndexInMemory, 0)
+			assert.Equal(t, td.expectedErr, err, name)
+			if err != nil {
+				return
+			}
+			var rows []string
+			for _, e := range index["a"] {
+				rows = append(rows, e.data)
+			}
+			assert.Equal(t, td.expectedRows, rows, name)
+			assert.Len(t, index["b"], 1, name)
+		})
+	}
+}
+
 func TestJMESQueryStringQuery(t *testing.T) {
 
 	tests := map[string]struct {
@@ -97,7 +202,7 @@ func TestJMESQueryStringQuery(t *testing.T) {
 			input:         `{"foo": {"bar": {"baz": [0, 1, 2, 3, 4]}}}`,
 			jsonQuery:     "foo",
 			expectedValue: "",
-			expectedErr:   errors.New("JMESpath query did not return a primitive type, this can't be joined on. Got: map[bar:map[baz:[0 1 2 3 4]]], type map[string]interface {}"),
+			expectedErr:   withCategory(ErrorCategoryKey, errors.New("JMESpath query did not return a primitive type, this can't be joined on. Got: map[bar:map[baz:[0 1 2 3 4]]], type map[string]interface {}")),
 		},
 	}
 
@@ -172,7 +277,7 @@ func TestColSplitting(t *testing.T) {
 				Separator:    ",",
 				JoinColumn:   3,
 			},
-			expectedErr: errors.New("failure to parse CSV and fetch column 3, only found 2 columns. Data: 1,2"),
+			expectedErr: withCategory(ErrorCategoryColumn, errors.New("failure to parse CSV and fetch column 3, only found 2 columns. Data: 1,2")),
 		},
 		"all cols": {
 			input: `{"data": "value"}`,
@@ -208,7 +313,49 @@ func TestColSplitting(t *testing.T) {
 				Separator:    "|",
 				JoinColumn:   2,
 			},
-			expectedErr: errors.New("couldn't split row with separator | and get '2'th column. Only 2 columns found. Remember this is zero-based index. \n\nRow contents: {\"data\": [\"123\", \"123\"]} | blah"),
+			expectedErr: withCategory(ErrorCategoryColumn, errors.New("couldn't split row with separator | and get '2'th column. Only 2 columns found. Remember this is zero-based index. \n\nRow contents: {\"data\": [\"123\", \"123\"]} | blah")),
+		},
+		"composite key of two CSV columns": {
+			input: `tenant-1,some data,user-2`,
+			queryoptions: QueryOptions{
+				Separator:   ",",
+				JoinColumns: []int{0, 2},
+			},
+			expectedValue: `["tenant-1","user-2"]`,
+		},
+		"composite key of two JMESpath queries on the entire row": {
+			input: `{"tenant": "tenant-1", "user": {"id": 2}}`,
+			queryoptions: QueryOptions{
+				JoinColumn:     -1,
+				JsonSubqueries: []string{"tenant", "user.id"},
+			},
+			expectedValue: `["tenant-1","2"]`,
+		},
+		"composite key pairing columns with queries": {
+			input: `tenant-1 | {"user": "user-2"}`,
+			queryoptions: QueryOptions{
+				Separator:      "|",
+				JoinColumns:    []int{0, 1},
+				JsonSubqueries: []string{"", "user"},
+			},
+			expectedValue: `["tenant-1","user-2"]`,
+		},
+		"composite key with an empty part is treated as empty": {
+			input: `tenant-1,,user-2`,
+			queryoptions: QueryOptions{
+				Separator:   ",",
+				JoinColumns: []int{0, 1},
+			},
+			expectedValue: "",
+		},
+		"error case: mismatched composite key parts": {
+			input: `a,b,c`,
+			queryoptions: QueryOptions{
+				Separator:      ",",
+				JoinColumns:    []int{0, 1},
+				JsonSubqueries: []string{"a", "b", "c"},
+			},
+			expectedErr: errors.New("can't pair up 2 join columns with 3 JSON subqueries for a composite key"),
 		},
 	}
 
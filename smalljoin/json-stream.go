@@ -0,0 +1,279 @@
+package smalljoin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/jmespath/go-jmespath"
+)
+
+// a field of a JMESPath, either a bare identifier or a quoted one
+var jsonPathField = regexp.MustCompile(`^(?:[A-Za-z_][A-Za-z0-9_]*|"(?:[^"\\]|\\.)*")`)
+
+// the fields to follow to the array of rows. Only a JMESPath made up of field
+// names can be followed as the JSON is streamed, without decoding all of it.
+func parseJSONArrayPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := jmespath.Compile(path); err != nil {
+		return nil, fmt.Errorf("not a valid JMESPath %q: %w", path, err)
+	}
+	var fields []string
+	rest := path
+	for {
+		match := jsonPathField.FindString(rest)
+		if match == "" {
+			return nil, fmt.Errorf("%q can't be streamed, only a path of field names such as data.items can be", path)
+		}
+		field := match
+		if strings.HasPrefix(match, `"`) {
+			// quoted identifiers are JSON strings
+			if err := json.Unmarshal([]byte(match), &field); err != nil {
+				return nil, fmt.Errorf("not a valid JMESPath %q: %w", path, err)
+			}
+		}
+		fields = append(fields, field)
+		rest = rest[len(match):]
+		if rest == "" {
+			return fields, nil
+		}
+		if rest[0] != '.' {
+			return nil, fmt.Errorf("%q can't be streamed, only a path of field names such as data.items can be", path)
+		}
+		rest = rest[1:]
+	}
+}
+
+// keeps track of the newlines which have been read, so that the line
+// number of a byte offset can be found without going back over the input
+type lineCounter struct {
+	r    io.Reader
+	read int64
+	// the offsets of the newlines read past the last offset asked about
+	newlines []int64
+	line     int64
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for i := 0; i < n; {
+		next := bytes.IndexByte(p[i:n], '\n')
+		if next < 0 {
+			break
+		}
+		c.newlines = append(c.newlines, c.read+int64(i+next))
+		i += next + 1
+	}
+	c.read += int64(n)
+	return n, err
+}
+
+// the line number of offset, which can't be before the last one asked about
+func (c *lineCounter) lineAt(offset int64) int64 {
+	i := 0
+	for i < len(c.newlines) && c.newlines[i] < offset {
+		i++
+	}
+	c.line += int64(i)
+	c.newlines = c.newlines[i:]
+	return c.line
+}
+
+// reads the rows of JSON which isn't split up by lines: the elements of a
+// top-level array, or of the array at the path inside each top-level value,
+// or otherwise each top-level value. It goes a token at a time, so only
+// a single row is ever held in memory. Each row is kept as it was written,
+// so that its offset and length still point at it in the file.
+type jsonRecordReader struct {
+	dec   *json.Decoder
+	lines *lineCounter
+	path  []string
+	// whether it's part of the way through an array of rows,
+	// and how many objects on the path to it are left open
+	inArray bool
+	open    int
+}
+
+func newJSONRecordReader(r io.Reader, q QueryOptions) (*jsonRecordReader, error) {
+	path, err := parseJSONArrayPath(q.JSONArrayPath)
+	if err != nil {
+		return nil, err
+	}
+	lines := &lineCounter{r: r, line: 1}
+	return &jsonRecordReader{dec: json.NewDecoder(lines), lines: lines, path: path}, nil
+}
+
+// returns the next row, or io.EOF once there are no more
+func (r *jsonRecordReader) next() (record, error) {
+	for {
+		if r.inArray {
+			if r.dec.More() {
+				return r.value()
+			}
+			// the end of the array
+			if _, err := r.dec.Token(); err != nil {
+				return record{}, r.failed(err)
+			}
+			r.inArray = false
+			if err := r.closeObjects(); err != nil {
+				return record{}, err
+			}
+			continue
+		}
+
+		if !r.dec.More() {
+			tok, err := r.dec.Token()
+			switch {
+			case err == io.EOF:
+				return record{}, io.EOF
+			case err == nil:
+				return record{}, withCategory(ErrorCategoryJSON, fmt.Errorf("unexpected %v at byte offset %d", tok, r.dec.InputOffset()))
+			}
+			return record{}, r.failed(err)
+		}
+		if len(r.path) == 0 {
+			if r.peek() != '[' {
+				return r.value()
+			}
+			if _, err := r.dec.Token(); err != nil {
+				return record{}, r.failed(err)
+			}
+			r.inArray = true
+			continue
+		}
+		if err := r.descend(); err != nil {
+			return record{}, err
+		}
+	}
+}
+
+// the first byte of the next top-level value, which More has buffered
+func (r *jsonRecordReader) peek() byte {
+	buffered := r.dec.Buffered()
+	var b [1]byte
+	for {
+		if n, _ := buffered.Read(b[:]); n == 0 {
+			return 0
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			return b[0]
+		}
+	}
+}
+
+// whether there's more of the input already buffered, beyond the
+// punctuation between values, so reading the next row won't block on it
+func (r *jsonRecordReader) buffered() bool {
+	var b [64]byte
+	n, _ := r.dec.Buffered().Read(b[:])
+	return len(bytes.TrimLeft(b[:n], " \t\r\n,:]}")) > 0
+}
+
+func (r *jsonRecordReader) value() (record, error) {
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err != nil {
+		return record{}, r.failed(err)
+	}
+	offset := r.dec.InputOffset() - int64(len(raw))
+	return record{data: string(raw), line: r.lines.lineAt(offset), offset: offset}, nil
+}
+
+// follows the path into the next top-level value, up to the start of the
+// array's elements. If the path isn't there, or it's null, there are no
+// rows in the value.
+func (r *jsonRecordReader) descend() error {
+	for _, field := range r.path {
+		tok, err := r.dec.Token()
+		if err != nil {
+			return r.failed(err)
+		}
+		if tok == nil {
+			return r.closeObjects()
+		}
+		if tok != json.Delim('{') {
+			return withCategory(ErrorCategoryJSON, fmt.Errorf("expected an object at byte offset %d to find %q in, on the way to the array of rows", r.dec.InputOffset(), field))
+		}
+		r.open++
+		found, err := r.findField(field)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return r.closeObjects()
+		}
+	}
+	tok, err := r.dec.Token()
+	switch {
+	case err != nil:
+		return r.failed(err)
+	case tok == json.Delim('['):
+		r.inArray = true
+		return nil
+	case tok == nil:
+		return r.closeObjects()
+	}
+	return withCategory(ErrorCategoryJSON, fmt.Errorf("expected an array of rows at byte offset %d", r.dec.InputOffset()))
+}
+
+// skips through the object up to the value of the field, returning false
+// if it isn't there
+func (r *jsonRecordReader) findField(field string) (bool, error) {
+	for r.dec.More() {
+		key, err := r.dec.Token()
+		if err != nil {
+			return false, r.failed(err)
+		}
+		if key == field {
+			return true, nil
+		}
+		if err := r.skipValue(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// skips the rest of the objects which were opened on the way to the array
+func (r *jsonRecordReader) closeObjects() error {
+	for ; r.open > 0; r.open-- {
+		for r.dec.More() {
+			if _, err := r.dec.Token(); err != nil {
+				return r.failed(err)
+			}
+			if err := r.skipValue(); err != nil {
+				return err
+			}
+		}
+		if _, err := r.dec.Token(); err != nil {
+			return r.failed(err)
+		}
+	}
+	return nil
+}
+
+func (r *jsonRecordReader) skipValue() error {
+	var skipped json.RawMessage
+	if err := r.dec.Decode(&skipped); err != nil {
+		return r.failed(err)
+	}
+	return nil
+}
+
+// categorises an error partway through the JSON, where running out
+// of input means it was cut short
+func (r *jsonRecordReader) failed(err error) error {
+	var syntaxErr *json.SyntaxError
+	switch {
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF):
+		return withCategory(ErrorCategoryJSON, fmt.Errorf("the JSON ends unexpectedly at byte offset %d", r.dec.InputOffset()))
+	case errors.As(err, &syntaxErr):
+		return withCategory(ErrorCategoryJSON, fmt.Errorf("failed to parse JSON at byte offset %d: %w", syntaxErr.Offset, err))
+	}
+	return withCategory(ErrorCategoryInput, fmt.Errorf("failed to read JSON at byte offset %d: %w", r.dec.InputOffset(), err))
+}
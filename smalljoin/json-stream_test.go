@@ -0,0 +1,137 @@
+package smalljoin
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONRecordReader(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		path     string
+		expected []record
+	}{
+		"a top-level array": {
+			input: "[\n  {\"id\": 1},\n  {\"id\": 2}\n]\n",
+			expected: []record{
+				{data: `{"id": 1}`, line: 2, offset: 4},
+				{data: `{"id": 2}`, line: 3, offset: 17},
+			},
+		},
+		"concatenated, pretty-printed values": {
+			input: "{\n  \"id\": 1\n}\n{\n  \"id\": 2\n}",
+			expected: []record{
+				{data: "{\n  \"id\": 1\n}", line: 1, offset: 0},
+				{data: "{\n  \"id\": 2\n}", line: 4, offset: 14},
+			},
+		},
+		"scalars": {
+			input: `1 "two" [3]`,
+			expected: []record{
+				{data: `1`, line: 1, offset: 0},
+				{data: `"two"`, line: 1, offset: 2},
+				{data: `3`, line: 1, offset: 9},
+			},
+		},
+		"an array at a path": {
+			input: `{"meta":{"items":["no"]},"data":{"next":null,"items":[{"id":1},{"id":2}],"after":[1]}}`,
+			path:  "data.items",
+			expected: []record{
+				{data: `{"id":1}`, line: 1, offset: 54},
+				{data: `{"id":2}`, line: 1, offset: 63},
+			},
+		},
+		"pages of an array at a path": {
+			input: "{\"items\":[1,2]}\n{\"items\":null}\n{\"other\":[3]}\n{\"items\":[4]}\n",
+			path:  `"items"`,
+			expected: []record{
+				{data: `1`, line: 1, offset: 10},
+				{data: `2`, line: 1, offset: 12},
+				{data: `4`, line: 4, offset: 55},
+			},
+		},
+		"empty": {
+			input: " \n",
+		},
+	}
+	for name, test := range tests {
+		// read a byte at a time, so that values are split across reads
+		r, err := newJSONRecordReader(iotest.OneByteReader(strings.NewReader(test.input)), QueryOptions{JSONArrayPath: test.path})
+		assert.NoError(t, err, name)
+		var out []record
+		for {
+			rec, err := r.next()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err, name) {
+				break
+			}
+			out = append(out, rec)
+		}
+		assert.Equal(t, test.expected, out, name)
+		for _, rec := range out {
+			assert.Equal(t, rec.data, test.input[rec.offset:rec.offset+int64(len(rec.data))], name)
+		}
+	}
+}
+
+func TestJSONRecordReaderErrors(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		path     string
+		category string
+	}{
+		"cut short":               {input: `[{"id":1},{"id"`, category: ErrorCategoryJSON},
+		"invalid":                 {input: `[{"id":1},{id}]`, category: ErrorCategoryJSON},
+		"a stray bracket":         {input: `[1]]`, category: ErrorCategoryJSON},
+		"not an array at a path":  {input: `{"items":{"id":1}}`, path: "items", category: ErrorCategoryJSON},
+		"not an object on a path": {input: `{"data":[1]}`, path: "data.items", category: ErrorCategoryJSON},
+		"a read error":            {input: `[1,2,3]`, category: ErrorCategoryInput},
+	}
+	for name, test := range tests {
+		var in io.Reader = strings.NewReader(test.input)
+		if test.category == ErrorCategoryInput {
+			in = iotest.TimeoutReader(iotest.OneByteReader(in))
+		}
+		r, err := newJSONRecordReader(in, QueryOptions{JSONArrayPath: test.path})
+		assert.NoError(t, err, name)
+		for err == nil {
+			_, err = r.next()
+		}
+		assert.NotEqual(t, io.EOF, err, name)
+		assert.Equal(t, test.category, ErrorCategory(err), name)
+	}
+}
+
+func TestParseJSONArrayPath(t *testing.T) {
+	tests := map[string]struct {
+		path     string
+		expected []string
+		err      bool
+	}{
+		"none":              {path: "", expected: nil},
+		"a field":           {path: "items", expected: []string{"items"}},
+		"nested fields":     {path: "data.items", expected: []string{"data", "items"}},
+		"quoted fields":     {path: `data."the items"`, expected: []string{"data", "the items"}},
+		"not a JMESPath":    {path: "data.", err: true},
+		"not just fields":   {path: "data.items[0].children", err: true},
+		"a function":        {path: "sort(items)", err: true},
+		"a filter":          {path: "items[?id > `1`]", err: true},
+		"a wildcard":        {path: "data.*", err: true},
+		"a quoted subfield": {path: `"a.b".c`, expected: []string{"a.b", "c"}},
+	}
+	for name, test := range tests {
+		fields, err := parseJSONArrayPath(test.path)
+		if test.err {
+			assert.Error(t, err, name)
+			continue
+		}
+		assert.NoError(t, err, name)
+		assert.Equal(t, test.expected, fields, name)
+	}
+}
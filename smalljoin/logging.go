@@ -0,0 +1,188 @@
+package smalljoin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFormat is how the logs are written out
+type LogFormat int
+
+const (
+	// logfmt style text, coloured when it's written to a terminal
+	LogFormatText LogFormat = iota
+	// a JSON object per line
+	LogFormatJSON
+)
+
+// the kinds of error, which are given as the category of each error in the logs
+const (
+	ErrorCategoryJSON     = "json"
+	ErrorCategoryCSV      = "csv"
+	ErrorCategoryColumn   = "column"
+	ErrorCategoryKey      = "key"
+	ErrorCategoryUnsorted = "unsorted"
+	ErrorCategoryIndex    = "index"
+	ErrorCategoryInput    = "input"
+	ErrorCategoryBudget   = "budget"
+	ErrorCategoryOther    = "other"
+)
+
+// an error, along with what kind of error it is
+type categorisedError struct {
+	category string
+	err      error
+}
+
+func (e *categorisedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorisedError) Unwrap() error {
+	return e.err
+}
+
+func withCategory(category string, err error) error {
+	return &categorisedError{category: category, err: err}
+}
+
+// ErrorCategory gives what kind of error it is, such as a
+// row which isn't valid JSON or the error budget being exceeded
+func ErrorCategory(err error) string {
+	var budgetErr *ErrorBudgetExceeded
+	if errors.As(err, &budgetErr) {
+		return ErrorCategoryBudget
+	}
+	var categorised *categorisedError
+	if errors.As(err, &categorised) {
+		return categorised.category
+	}
+	return ErrorCategoryOther
+}
+
+// NewLogger creates a logger for the joiner's diagnostics, writing them
+// to w. The text format is only coloured when w is a terminal.
+func NewLogger(w io.Writer, format LogFormat, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	if IsTerminal(w) {
+		return slog.New(&colourHandler{w: w, level: level, lock: &sync.Mutex{}})
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// the logger used when none is given in the options, which is
+// only as verbose as debug logs when OutputDebugMode is set
+func defaultLogger(w io.Writer, debug bool) *slog.Logger {
+	if w == nil {
+		w = io.Discard
+	}
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	return NewLogger(w, LogFormatText, level)
+}
+
+// IsTerminal reports whether w is a terminal, which it can be if it's
+// a file, or anything else which can be stat'd like one
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return false
+	}
+	s, err := f.Stat()
+	return err == nil && s.Mode()&os.ModeCharDevice != 0
+}
+
+// writes logs as text for a person to read, with the levels coloured in
+type colourHandler struct {
+	w      io.Writer
+	level  slog.Level
+	lock   *sync.Mutex
+	prefix string
+	attrs  []byte
+}
+
+var levelColours = map[slog.Level]string{
+	slog.LevelDebug: "\033[36m",
+	slog.LevelInfo:  "\033[32m",
+	slog.LevelWarn:  "\033[33m",
+	slog.LevelError: "\033[31m",
+}
+
+func (h *colourHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *colourHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if !r.Time.IsZero() {
+		buf.WriteString(r.Time.Format(time.TimeOnly))
+		buf.WriteByte(' ')
+	}
+	fmt.Fprintf(&buf, "%s%-5s\033[0m %s", levelColours[r.Level], r.Level.String(), r.Message)
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *colourHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	c := *h
+	c.attrs = buf.Bytes()
+	return &c
+}
+
+func (h *colourHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix = prefix + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, prefix, ga)
+		}
+		return
+	}
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " =\"\n\t") {
+		v = strconv.Quote(v)
+	}
+	fmt.Fprintf(buf, " \033[2m%s%s=\033[0m%s", prefix, a.Key, v)
+}
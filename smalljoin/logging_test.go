@@ -0,0 +1,88 @@
+package smalljoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCategory(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected string
+	}{
+		"a row which isn't JSON": {
+			err:      &RowError{Err: withCategory(ErrorCategoryJSON, errors.New("failure to deserialize JSON"))},
+			expected: ErrorCategoryJSON,
+		},
+		"wrapped": {
+			err:      fmt.Errorf("failed: %w", withCategory(ErrorCategoryIndex, errors.New("no"))),
+			expected: ErrorCategoryIndex,
+		},
+		"the error budget": {
+			err:      &ErrorBudgetExceeded{Errored: 2, LinesRead: 3},
+			expected: ErrorCategoryBudget,
+		},
+		"anything else": {
+			err:      errors.New("something"),
+			expected: ErrorCategoryOther,
+		},
+	}
+	for name, td := range tests {
+		assert.Equal(t, td.expected, ErrorCategory(td.err), name)
+	}
+}
+
+func TestColourHandler(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	logger := slog.New(&colourHandler{w: out, level: slog.LevelInfo, lock: &sync.Mutex{}})
+	logger.With("worker", 3).WithGroup("row").Warn("skipped", "line", 2, "error", "bad row")
+	logger.Debug("not shown")
+
+	assert.Contains(t, out.String(), "\033[33mWARN \033[0m skipped")
+	assert.Contains(t, out.String(), "worker=\033[0m3")
+	assert.Contains(t, out.String(), "row.line=\033[0m2")
+	assert.Contains(t, out.String(), "row.error=\033[0m\"bad row\"")
+	assert.NotContains(t, out.String(), "not shown")
+}
+
+func TestJSONLogsOfSkippedRows(t *testing.T) {
+	logs := bytes.NewBuffer(nil)
+	j := New(ioutil.NopCloser(strings.NewReader("a\nnot json\n")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		Jointype:      JoinTypeInner,
+		IndexFile:     "internal/testdata/index_4",
+		ContinueOnErr: true,
+		Logger:        NewLogger(logs, LogFormatJSON, slog.LevelInfo),
+		LeftQueryOptions: QueryOptions{
+			JoinColumn:   -1,
+			JsonSubquery: "id",
+		},
+		RightQueryOptions: QueryOptions{
+			JoinColumn: -1,
+		},
+	})
+	assert.NoError(t, j.RunContext(context.Background()))
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	if assert.Len(t, entries, 2) {
+		for _, entry := range entries {
+			assert.Equal(t, "WARN", entry["level"])
+			assert.Equal(t, ErrorCategoryJSON, entry["category"])
+			assert.NotNil(t, entry["worker"])
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package smalljoin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// a run of consecutive rows in the sorted index file which share a key
+type sortedIndexGroup struct {
+	key     string
+	entries []*indexEntry
+	matched bool
+	// the number of other rows with the key, including those
+	// which were dropped by the duplicate key policy
+	duplicates int
+}
+
+// reads the sorted index file one group of keys at a time,
+// so only the rows for a single key are held in memory
+type sortedIndexReader struct {
+	r          *bufio.Reader
+	json       *jsonRecordReader
+	options    QueryOptions
+	duplicates DuplicateKeyPolicy
+	offset     int64
+	lineNumber int
+	prevKey    string
+	peeked     *indexEntry
+	peekedKey  string
+	done       bool
+}
+
+func newSortedIndexReader(r io.Reader, options QueryOptions, duplicates DuplicateKeyPolicy) (*sortedIndexReader, error) {
+	s := &sortedIndexReader{
+		options:    options,
+		duplicates: duplicates,
+	}
+	if options.Format == FormatJSON {
+		var err error
+		if s.json, err = newJSONRecordReader(r, options); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s.r = bufio.NewReader(r)
+	if options.Header {
+		line, err := s.readLine()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if s.options.header == nil {
+			s.options, err = s.options.withHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse header of index file: %w", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *sortedIndexReader) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	s.offset += int64(len(line))
+	s.lineNumber++
+	return strings.TrimSuffix(line, "\n"), err
+}
+
+// reads the next row and the byte offset it starts at, with io.EOF
+// for the last one, which may be empty
+func (s *sortedIndexReader) readRow() (string, int64, error) {
+	if s.json != nil {
+		rec, err := s.json.next()
+		s.lineNumber = int(rec.line)
+		return rec.data, rec.offset, err
+	}
+	offset := s.offset
+	line, err := s.readLine()
+	return line, offset, err
+}
+
+// returns the next row with a non-empty key, or nil at the end of the file
+func (s *sortedIndexReader) next() (string, *indexEntry, error) {
+	if s.peeked != nil {
+		e, k := s.peeked, s.peekedKey
+		s.peeked = nil
+		return k, e, nil
+	}
+	for !s.done {
+		line, offset, err := s.readRow()
+		if err == io.EOF {
+			s.done = true
+		} else if err != nil {
+			return "", nil, err
+		}
+		k, err := attemptSplitAndSelectCol(line, s.options)
+		if err != nil {
+			return "", nil, err
+		}
+		if k == "" {
+			continue
+		}
+		if k < s.prevKey {
+			return "", nil, withCategory(ErrorCategoryUnsorted, fmt.Errorf("index file is not sorted: key %q on line %d comes after %q", k, s.lineNumber, s.prevKey))
+		}
+		s.prevKey = k
+		return k, &indexEntry{data: line, offset: offset, length: len(line)}, nil
+	}
+	return "", nil, nil
+}
+
+// returns the next group of rows sharing a key, applying the duplicate key policy
+// to it, or nil at the end of the file
+func (s *sortedIndexReader) nextGroup() (*sortedIndexGroup, error) {
+	k, e, err := s.next()
+	if err != nil || e == nil {
+		return nil, err
+	}
+	g := &sortedIndexGroup{key: k, entries: []*indexEntry{e}}
+	for {
+		k, e, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return g, nil
+		}
+		if k != g.key {
+			s.peeked, s.peekedKey = e, k
+			return g, nil
+		}
+		g.duplicates++
+		switch s.duplicates {
+		case DuplicateKeysAll:
+			g.entries = append(g.entries, e)
+		case DuplicateKeysLast:
+			g.entries = []*indexEntry{e}
+		case DuplicateKeysError:
+			return nil, fmt.Errorf("duplicate key %q found in index file on line %d", k, s.lineNumber)
+		}
+	}
+}
+
+// runMergeJoin joins the incoming stream against the index file where both
+// are sorted by their join key, by stepping through the two of them together
+// like unix `join`. Neither side is held in memory, beyond the index rows
+// for the current key. Keys are compared as strings, byte by byte, ie, the
+// order given by `LC_ALL=C sort`.
+func (j *joiner) runMergeJoin(ctx context.Context, input io.ReadCloser) error {
+	if j.options.IndexFile == "" || j.options.PrebuiltIndex != "" {
+		return fmt.Errorf("sorted inputs can only be joined against an index file")
+	}
+	f, err := os.Open(j.options.IndexFile)
+	if err != nil {
+		return fmt.Errorf("failed to open index file: %w", err)
+	}
+	defer f.Close()
+	right, err := newSortedIndexReader(f, j.options.RightQueryOptions, j.options.DuplicateKeys)
+	if err != nil {
+		return err
+	}
+	j.options.RightQueryOptions = right.options
+
+	// the results are written out as they're joined, so there's
+	// nothing to reorder
+	j.window = nil
+	j.startReading(ctx, input)
+
+	// counts the index as it's read through, as it's never all loaded
+	nextGroup := func() (*sortedIndexGroup, error) {
+		g, err := right.nextGroup()
+		if g != nil {
+			j.stats.indexGroupRead(g)
+		}
+		return g, err
+	}
+
+	group, err := nextGroup()
+	if err != nil {
+		return err
+	}
+	var prevLeftKey string
+	for datablock := range j.incoming {
+		for _, rec := range datablock.records {
+			line := rec.data
+			leftKey, err := attemptSplitAndSelectCol(line, j.options.LeftQueryOptions)
+			if err != nil {
+				j.rowFailed(rec, err)
+				continue
+			}
+			if leftKey == "" {
+				j.stats.rowJoined("", false)
+				j.writeOutResult(Result{}, rec)
+				continue
+			}
+			if leftKey < prevLeftKey {
+				return newRowError(rec, withCategory(ErrorCategoryUnsorted, fmt.Errorf("incoming stream is not sorted: key %q comes after %q", leftKey, prevLeftKey)))
+			}
+			prevLeftKey = leftKey
+
+			for group != nil && group.key < leftKey {
+				j.emitSortedIndexGroup(group)
+				if group, err = nextGroup(); err != nil {
+					return err
+				}
+			}
+			start := j.metrics.joinLatency.start()
+			j.mergeLeftRow(rec, leftKey, group)
+			j.metrics.joinLatency.observeSince(start)
+		}
+		atomic.StoreInt64(&j.stats.lastOffset, datablock.end)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for group != nil {
+		j.emitSortedIndexGroup(group)
+		if group, err = nextGroup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *joiner) mergeLeftRow(rec record, leftKey string, group *sortedIndexGroup) {
+	line := rec.data
+	left := j.options.LeftQueryOptions.leftResult(leftKey, line)
+	matched := group != nil && group.key == leftKey
+	results := []Result{{Left: left}}
+	if matched {
+		results = results[:0]
+		for _, e := range group.entries {
+			results = append(results, Result{
+				Left: left,
+				Right: &RightResult{
+					IndexFileResult: j.options.RightQueryOptions.indexFileResult(group.key, e.data),
+				},
+			})
+		}
+	}
+	var out bytes.Buffer
+	if err := j.writeResultsTo(&out, j.logger, results, rec); err != nil {
+		j.rowFailed(rec, err)
+		return
+	}
+	j.stats.rowJoined(leftKey, matched)
+	if matched {
+		group.matched = true
+	}
+	j.streams.output.Write(out.Bytes())
+}
+
+// writes out the group's rows if they were never matched,
+// for the joins which include unmatched index rows
+func (j *joiner) emitSortedIndexGroup(group *sortedIndexGroup) {
+	if group.matched || !requiresIndexFile(j.options.Jointype) {
+		return
+	}
+	for _, e := range group.entries {
+		j.writeOutResult(Result{
+			Right: &RightResult{
+				IndexFileResult: j.options.RightQueryOptions.indexFileResult(group.key, e.data),
+			},
+		}, record{})
+	}
+}
@@ -0,0 +1,114 @@
+package smalljoin
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeJoin(t *testing.T) {
+	dir := t.TempDir()
+	indexFile := filepath.Join(dir, "index")
+	err := ioutil.WriteFile(indexFile, []byte("b,1\nb,2\nc,3\nd,4\ne,5\n"), 0644)
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		input          string
+		jointype       Jointype
+		expectedoutput string
+		expectedErr    error
+	}{
+		"inner join with duplicate keys on both sides": {
+			input:    "a\nb\nb\nd\nf\n",
+			jointype: JoinTypeInner,
+			expectedoutput: `
+{"Left":{"Index":"b","Row":"b"},"Right":{"IndexFileResult":{"Index":"b","Row":"b,1"}}}
+{"Left":{"Index":"b","Row":"b"},"Right":{"IndexFileResult":{"Index":"b","Row":"b,1"}}}
+{"Left":{"Index":"b","Row":"b"},"Right":{"IndexFileResult":{"Index":"b","Row":"b,2"}}}
+{"Left":{"Index":"b","Row":"b"},"Right":{"IndexFileResult":{"Index":"b","Row":"b,2"}}}
+{"Left":{"Index":"d","Row":"d"},"Right":{"IndexFileResult":{"Index":"d","Row":"d,4"}}}
+			`,
+		},
+		"right-is-null join": {
+			input:    "a\nb\nd\nf\n",
+			jointype: JoinTypeRightIsNull,
+			expectedoutput: `
+{"Left":{"Index":"a","Row":"a"},"Right":null}
+{"Left":{"Index":"f","Row":"f"},"Right":null}
+			`,
+		},
+		"full join": {
+			input:    "a\nb\nd\nf\n",
+			jointype: JoinTypeFull,
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"c","Row":"c,3"}}}
+{"Left":null,"Right":{"IndexFileResult":{"Index":"e","Row":"e,5"}}}
+{"Left":{"Index":"a","Row":"a"},"Right":null}
+{"Left":{"Index":"b","Row":"b"},"Right":{"IndexFileResult":{"Index":"b","Row":"b,1"}}}
+{"Left":{"Index":"b","Row":"b"},"Right":{"IndexFileResult":{"Index":"b","Row":"b,2"}}}
+{"Left":{"Index":"d","Row":"d"},"Right":{"IndexFileResult":{"Index":"d","Row":"d,4"}}}
+{"Left":{"Index":"f","Row":"f"},"Right":null}
+			`,
+		},
+		"left-is-null join": {
+			input:    "a\nb\nd\nf\n",
+			jointype: JoinTypeLeftIsNull,
+			expectedoutput: `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"c","Row":"c,3"}}}
+{"Left":null,"Right":{"IndexFileResult":{"Index":"e","Row":"e,5"}}}
+			`,
+		},
+		"out of order input": {
+			input:       "a\nd\nb\n",
+			jointype:    JoinTypeInner,
+			expectedErr: &RowError{Line: 3, Offset: 4, Row: "b", Err: withCategory(ErrorCategoryUnsorted, errors.New(`incoming stream is not sorted: key "b" comes after "d"`))},
+		},
+	}
+
+	for name, td := range tests {
+		t.Run(name, func(t *testing.T) {
+			outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+			errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+			j := New(ioutil.NopCloser(strings.NewReader(td.input)), outStream, errStream, Options{
+				Jointype:     td.jointype,
+				IndexFile:    indexFile,
+				SortedInputs: true,
+				RightQueryOptions: QueryOptions{
+					Separator:  ",",
+					JoinColumn: 0,
+				},
+				LeftQueryOptions: QueryOptions{
+					JoinColumn: -1,
+				},
+			})
+			err := j.Run()
+			assert.Equal(t, td.expectedErr, err, name)
+			if err == nil {
+				sortAndCompare(t, td.expectedoutput, outStream.Bytes())
+			}
+		})
+	}
+}
+
+func TestMergeJoinUnsortedIndex(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	err := ioutil.WriteFile(indexFile, []byte("b\na\n"), 0644)
+	assert.NoError(t, err)
+
+	outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+	j := New(ioutil.NopCloser(strings.NewReader("c\n")), outStream, errStream, Options{
+		Jointype:          JoinTypeInner,
+		IndexFile:         indexFile,
+		SortedInputs:      true,
+		RightQueryOptions: QueryOptions{JoinColumn: -1},
+		LeftQueryOptions:  QueryOptions{JoinColumn: -1},
+	})
+	err = j.Run()
+	assert.Equal(t, withCategory(ErrorCategoryUnsorted, errors.New(`index file is not sorted: key "a" on line 2 comes after "b"`)), err)
+}
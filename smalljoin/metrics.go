@@ -0,0 +1,159 @@
+package smalljoin
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the upper bounds of the latency histograms' buckets, in seconds, from
+// a fast lookup in memory up to a slow command with -right-exec
+var latencyBuckets = []float64{
+	0.000001, 0.000005, 0.00001, 0.00005, 0.0001, 0.0005,
+	0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10,
+}
+
+// a histogram of durations, which can be observed by several workers at once.
+// A nil histogram ignores what it's given, for when metrics aren't collected.
+type histogram struct {
+	buckets []float64
+	// the number of observations in each bucket, with the last for anything
+	// larger than all of them, which are added up when they're written out,
+	// so that the count is always the same as the +Inf bucket
+	counts []uint64
+	// the float64 bits of the sum of the observations
+	sum uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	v := d.Seconds()
+	atomic.AddUint64(&h.counts[sort.SearchFloat64s(h.buckets, v)], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// when to time an observation from. The clock is only read when there's a
+// histogram, so rows aren't timed when metrics aren't collected.
+func (h *histogram) start() time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (h *histogram) observeSince(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.observe(time.Since(start))
+}
+
+// writes the histogram out in the Prometheus text format
+func (h *histogram) writeTo(w io.Writer, name string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))))
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
+
+// keeps the first error writing out the metrics, skipping the rest of the
+// writes after it, so that each write doesn't need to be checked
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *metricsWriter) Write(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err := m.w.Write(p)
+	m.err = err
+	return n, err
+}
+
+func formatFloat(v float64) string {
+	return strings.TrimSuffix(fmt.Sprintf("%g", v), ".0")
+}
+
+// the histograms which are only kept with CollectMetrics
+type joinMetrics struct {
+	joinLatency *histogram
+	execLatency *histogram
+}
+
+func newJoinMetrics(collect bool) joinMetrics {
+	if !collect {
+		return joinMetrics{}
+	}
+	return joinMetrics{
+		joinLatency: newHistogram(latencyBuckets),
+		execLatency: newHistogram(latencyBuckets),
+	}
+}
+
+// WriteMetrics writes out the join's metrics in the Prometheus text format
+func (j *joiner) WriteMetrics(out io.Writer) error {
+	w := &metricsWriter{w: out}
+	stats := j.Stats()
+	metric := func(name string, kind string, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("smalljoin_lines_processed_total", "counter", "Rows of the incoming stream which have been processed, including those which couldn't be joined.", stats.LinesRead)
+	metric("smalljoin_bytes_processed", "gauge", "The byte offset in the incoming stream up to which every row has been joined.", stats.LastOffset)
+
+	fmt.Fprintf(w, "# HELP smalljoin_rows_total Rows of the incoming stream, by how they were joined.\n# TYPE smalljoin_rows_total counter\n")
+	for _, r := range []struct {
+		result string
+		n      int64
+	}{{"matched", stats.Matched}, {"unmatched", stats.Unmatched}, {"empty_key", stats.EmptyKey}, {"errored", stats.Errored}} {
+		fmt.Fprintf(w, "smalljoin_rows_total{result=%q} %d\n", r.result, r.n)
+	}
+
+	fmt.Fprintf(w, "# HELP smalljoin_errors_total Rows which couldn't be joined, by the category of error.\n# TYPE smalljoin_errors_total counter\n")
+	categories := make([]string, 0, len(stats.ErrorsByCategory))
+	for category := range stats.ErrorsByCategory {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		fmt.Fprintf(w, "smalljoin_errors_total{category=%q} %d\n", category, stats.ErrorsByCategory[category])
+	}
+
+	metric("smalljoin_incoming_queue_depth", "gauge", "Blocks of the incoming stream waiting for a worker to join them.", len(j.incoming))
+	metric("smalljoin_incoming_queue_capacity", "gauge", "The number of blocks which can wait for a worker.", cap(j.incoming))
+	metric("smalljoin_index_keys", "gauge", "Keys in the index.", stats.IndexKeys)
+	metric("smalljoin_index_rows", "gauge", "Rows in the index.", stats.IndexRows)
+
+	if j.metrics.joinLatency != nil {
+		j.metrics.joinLatency.writeTo(w, "smalljoin_join_duration_seconds", "How long it took to join each row of the incoming stream.")
+	}
+	if j.metrics.execLatency != nil && j.options.RightExecStr != "" {
+		j.metrics.execLatency.writeTo(w, "smalljoin_exec_duration_seconds", "How long each command run for -right-exec-with-exit-code took.")
+	}
+	if w.err != nil {
+		return fmt.Errorf("failed to write metrics: %w", w.err)
+	}
+	return nil
+}
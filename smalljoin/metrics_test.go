@@ -0,0 +1,120 @@
+package smalljoin
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.001, 0.1, 1})
+	for _, d := range []time.Duration{500 * time.Microsecond, 50 * time.Millisecond, 50 * time.Millisecond, 2 * time.Second} {
+		h.observe(d)
+	}
+	var nilHistogram *histogram
+	nilHistogram.observe(time.Second)
+	assert.True(t, nilHistogram.start().IsZero(), "the clock shouldn't be read without a histogram")
+	nilHistogram.observeSince(time.Now())
+
+	out := bytes.NewBuffer(nil)
+	h.writeTo(out, "test_seconds", "A test.")
+	assert.Equal(t, `# HELP test_seconds A test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.001"} 1
+test_seconds_bucket{le="0.1"} 3
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 2.1005
+test_seconds_count 4
+`, out.String())
+}
+
+func TestWriteMetrics(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte("a\nb\n"), 0644))
+
+	tests := map[string]struct {
+		options  Options
+		expected []string
+		missing  []string
+	}{
+		"counters only, without CollectMetrics": {
+			options: Options{IndexFile: indexFile, ContinueOnErr: true, LeftQueryOptions: QueryOptions{JoinColumn: -1, JsonSubquery: "id"}},
+			expected: []string{
+				"smalljoin_lines_processed_total 4\n",
+				`smalljoin_rows_total{result="matched"} 2` + "\n",
+				`smalljoin_rows_total{result="errored"} 1` + "\n",
+				`smalljoin_errors_total{category="json"} 1` + "\n",
+				"smalljoin_incoming_queue_depth 0\n",
+				"smalljoin_index_keys 2\n",
+			},
+			missing: []string{"smalljoin_join_duration_seconds", "smalljoin_exec_duration_seconds"},
+		},
+		"join latency": {
+			options:  Options{IndexFile: indexFile, CollectMetrics: true, LeftQueryOptions: QueryOptions{JoinColumn: -1}},
+			expected: []string{`smalljoin_join_duration_seconds_bucket{le="+Inf"} 4` + "\n", "smalljoin_join_duration_seconds_count 4\n"},
+			missing:  []string{"smalljoin_exec_duration_seconds"},
+		},
+		"exec latency": {
+			options:  Options{RightExecStr: "exit 0", CollectMetrics: true, LeftQueryOptions: QueryOptions{JoinColumn: -1}},
+			expected: []string{"smalljoin_exec_duration_seconds_count 4\n"},
+		},
+	}
+	for name, td := range tests {
+		td.options.Jointype = JoinTypeInner
+		td.options.RightQueryOptions = QueryOptions{JoinColumn: -1}
+		input := "a\nb\nc\nd\n"
+		if td.options.LeftQueryOptions.JsonSubquery != "" {
+			input = "{\"id\":\"a\"}\n{\"id\":\"b\"}\nnot json\n{\"id\":\"c\"}\n"
+		}
+		j := New(ioutil.NopCloser(strings.NewReader(input)), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), td.options)
+		assert.NoError(t, j.Run(), name)
+
+		out := bytes.NewBuffer(nil)
+		assert.NoError(t, j.WriteMetrics(out), name)
+		for _, e := range td.expected {
+			assert.Contains(t, out.String(), e, name)
+		}
+		for _, m := range td.missing {
+			assert.NotContains(t, out.String(), m, name)
+		}
+	}
+}
+
+// fails once more than limit bytes have been written to it
+type failingWriter struct {
+	limit   int
+	written int
+	writes  int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.written+len(p) > w.limit {
+		return 0, errors.New("broken pipe")
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestWriteMetricsError(t *testing.T) {
+	j := New(ioutil.NopCloser(strings.NewReader("a\n")), createNoopWriteCloser(bytes.NewBuffer(nil)), createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+		Jointype:          JoinTypeInner,
+		RightExecStr:      "exit 0",
+		CollectMetrics:    true,
+		LeftQueryOptions:  QueryOptions{JoinColumn: -1},
+		RightQueryOptions: QueryOptions{JoinColumn: -1},
+	})
+	assert.NoError(t, j.Run())
+
+	w := &failingWriter{limit: 100}
+	assert.EqualError(t, j.WriteMetrics(w), "failed to write metrics: broken pipe")
+	// nothing more is written once a write has failed
+	assert.Equal(t, 1, w.writes)
+}
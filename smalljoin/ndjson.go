@@ -0,0 +1,65 @@
+package smalljoin
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// the JMESPath queries for the key of a row of NDJSON
+func (q QueryOptions) ndjsonQueries() []string {
+	if len(q.JsonSubqueries) > 0 {
+		return q.JsonSubqueries
+	}
+	if q.JsonSubquery != "" {
+		return []string{q.JsonSubquery}
+	}
+	return nil
+}
+
+func (q QueryOptions) validateFormat(side string) error {
+	if q.JSONArrayPath != "" {
+		if q.Format != FormatJSON {
+			return fmt.Errorf("the %s side's JSON array path can only be used with the json format", side)
+		}
+		if _, err := parseJSONArrayPath(q.JSONArrayPath); err != nil {
+			return fmt.Errorf("invalid %s JSON array path: %w", side, err)
+		}
+	}
+	if q.Format == FormatDelimited {
+		return nil
+	}
+	if len(q.ndjsonQueries()) == 0 {
+		return fmt.Errorf("the %s side is JSON, so it needs a JSON subquery to join on", side)
+	}
+	if q.Header {
+		return fmt.Errorf("the %s side is JSON, so it can't have a header", side)
+	}
+	columns := q.JoinColumns
+	if len(columns) == 0 {
+		columns = []int{q.JoinColumn}
+	}
+	for _, col := range columns {
+		if col >= 0 {
+			return fmt.Errorf("the %s side is JSON, so it's joined on JSON subqueries rather than columns", side)
+		}
+	}
+	return nil
+}
+
+// decodes a row of NDJSON just the once, for all of the parts of its key
+func selectNDJSONKey(row string, options QueryOptions) (string, error) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(row), &data); err != nil {
+		return "", withCategory(ErrorCategoryJSON, fmt.Errorf("failure to deserialize JSON, %v. Data %v", err, row))
+	}
+	queries := options.ndjsonQueries()
+	parts := make([]string, 0, len(queries))
+	for _, query := range queries {
+		part, err := queryJSONKey(data, query)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	return combineKeyParts(parts)
+}
@@ -1,14 +1,70 @@
 package smalljoin
 
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
 const defaultConcurrency = 10
 const defaultInputByteLen = 5000
 
+// how many blocks, per worker, can be held waiting
+// to be written out in order with PreserveOrder
+const reorderWindowPerWorker = 4
+
 type Jointype int
 
 const (
 	JoinTypeInner = iota
 	JoinTypeLeft
 	JoinTypeRightIsNull
+	JoinTypeRight
+	JoinTypeFull
+	JoinTypeLeftIsNull
+)
+
+// DuplicateKeyPolicy determines what happens when several rows
+// in the index file share the same join key
+type DuplicateKeyPolicy int
+
+const (
+	// keep every row, and emit one result per matching row (SQL semantics)
+	DuplicateKeysAll DuplicateKeyPolicy = iota
+	// keep only the first row seen for a key
+	DuplicateKeysFirst
+	// keep only the last row seen for a key
+	DuplicateKeysLast
+	// fail to build the index if any key is repeated
+	DuplicateKeysError
+)
+
+// IndexMode determines how the index file is held while joining
+type IndexMode int
+
+const (
+	// the index file's rows are all read into memory
+	IndexInMemory IndexMode = iota
+	// only the keys and the byte offsets of the index file's rows are
+	// held in memory, the rows themselves are read from the file as needed
+	IndexOnDisk
+)
+
+// InputFormat is how the rows of an input are laid out
+type InputFormat int
+
+const (
+	// rows of text, which may be split up into columns with a separator
+	FormatDelimited InputFormat = iota
+	// a JSON value on each line, which is decoded once and joined on with
+	// JSON subqueries, and output as JSON rather than as a string
+	FormatNDJSON
+	// JSON which isn't split up by lines: the elements of a top-level array
+	// (or of the array at JSONArrayPath), or each of a run of concatenated
+	// values, which may be pretty-printed. Otherwise it's joined on and
+	// output just as with FormatNDJSON.
+	FormatJSON
 )
 
 type QueryOptions struct {
@@ -16,6 +72,100 @@ type QueryOptions struct {
 	Separator      string
 	JoinColumn     int
 	AttemptToClean bool
+
+	// JoinColumns and JsonSubqueries allow for a composite key
+	// made up of several columns and/or JMESPath queries. When set
+	// they take precedence over JoinColumn and JsonSubquery.
+	// Either may have a single entry, in which case it applies to
+	// every entry of the other, otherwise they're paired up in order.
+	JoinColumns    []int
+	JsonSubqueries []string
+
+	// Header specifies that the first row of the input contains the
+	// names of its columns. This allows for the join columns to be
+	// given by name with JoinColumnNames, and each column of the
+	// output rows to be labelled.
+	Header          bool
+	JoinColumnNames []string
+	// HeaderGiven means that Header was chosen explicitly, so whether
+	// there's a header isn't detected with SeparatorAuto
+	HeaderGiven bool
+
+	// Dialect is how the columns are quoted when they're split as a CSV
+	Dialect CSVDialect
+
+	// Format is how the rows are laid out, delimited text by default
+	Format InputFormat
+	// JSONArrayPath is a JMESPath of field names, eg data.items, to the array
+	// of rows inside each top-level value, for FormatJSON
+	JSONArrayPath string
+
+	// the column names, once the header row has been read
+	header []string
+}
+
+// a single part of the join key: a column (or -1 for the entire row),
+// optionally queried into with JMESPath
+type keyExtractor struct {
+	column       int
+	jsonSubquery string
+}
+
+// whether columns are split as a CSV, allowing them to be quoted, which
+// is the case for commas, or for any single character with a dialect
+func (q QueryOptions) csvColumns() bool {
+	return q.Separator == "," || (len(q.Separator) == 1 && q.Dialect != CSVDialect{})
+}
+
+// whether the rows are split up into CSV columns, in which case a
+// newline inside a quoted column doesn't end the row
+func (q QueryOptions) isCSV() bool {
+	if q.Format != FormatDelimited || !q.csvColumns() {
+		return false
+	}
+	if q.Header || len(q.JoinColumnNames) > 0 {
+		return true
+	}
+	extractors, err := q.keyExtractors()
+	if err != nil {
+		return false
+	}
+	for _, e := range extractors {
+		if e.column >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (q QueryOptions) keyExtractors() ([]keyExtractor, error) {
+	columns := q.JoinColumns
+	if len(columns) == 0 {
+		columns = []int{q.JoinColumn}
+	}
+	queries := q.JsonSubqueries
+	if len(queries) == 0 {
+		queries = []string{q.JsonSubquery}
+	}
+	n := len(columns)
+	if len(queries) > n {
+		n = len(queries)
+	}
+	if (len(columns) != n && len(columns) != 1) || (len(queries) != n && len(queries) != 1) {
+		return nil, fmt.Errorf("can't pair up %d join columns with %d JSON subqueries for a composite key", len(columns), len(queries))
+	}
+	out := make([]keyExtractor, n)
+	for i := range out {
+		out[i].column = columns[0]
+		if len(columns) > 1 {
+			out[i].column = columns[i]
+		}
+		out[i].jsonSubquery = queries[0]
+		if len(queries) > 1 {
+			out[i].jsonSubquery = queries[i]
+		}
+	}
+	return out, nil
 }
 
 type Options struct {
@@ -24,19 +174,98 @@ type Options struct {
 	IndexFile          string
 	RightExecStr       string
 	Jointype           Jointype
+	DuplicateKeys      DuplicateKeyPolicy
+	IndexMode          IndexMode
 	LeftQueryOptions   QueryOptions
 	RightQueryOptions  QueryOptions
 	ContinueOnErr      bool
 	OutputDebugMode    bool
+
+	// PrebuiltIndex is a path to an index built with BuildIndexFile, to
+	// use instead of parsing IndexFile. If IndexFile is also set, it
+	// overrides the path of the source file recorded in the index. The
+	// RightQueryOptions and DuplicateKeys it was built with replace those
+	// given here. Unless AllowStaleIndex is set, the index is refused if its
+	// source file has changed since it was built, going by its size and
+	// modification time, or with VerifyIndexChecksum, by its checksum instead.
+	PrebuiltIndex       string
+	AllowStaleIndex     bool
+	VerifyIndexChecksum bool
+
+	// SortedInputs declares that both the incoming stream and the index
+	// file are sorted by their join keys, so they can be merge joined
+	// without holding the index in memory
+	SortedInputs bool
+
+	// MaxMemory is a budget, in bytes, for the index. If the index would
+	// be larger, both the index file and the incoming stream are instead
+	// partitioned into buckets on disk and joined one bucket at a time.
+	MaxMemory int64
+
+	// BloomFalsePositiveRate, if set, builds a bloom filter of the index's
+	// keys with this rate of false positives (eg, 0.01), which is checked
+	// before looking up each key of the incoming stream in the index
+	BloomFalsePositiveRate float64
+
+	// PreserveOrder writes the results out in the same order as the
+	// rows of the incoming stream, while still joining concurrently
+	PreserveOrder bool
+
+	// Checkpoint is a file to record how far the join has got in, every
+	// CheckpointInterval, so that it can be resumed. It implies PreserveOrder,
+	// so that the output always lines up with the incoming stream.
+	Checkpoint         string
+	CheckpointInterval time.Duration
+
+	// MaxErrors and MaxErrorRate (a fraction of the rows read) are budgets
+	// for the rows which can't be joined. Those rows are skipped until the
+	// budget is exceeded, which stops the join with *ErrorBudgetExceeded.
+	// MaxErrors is nil for no budget, so that a budget of 0 rows can be
+	// given, and MaxErrorRate is 0 for none.
+	MaxErrors    *int64
+	MaxErrorRate float64
+
+	// Rejects, if set, is written the rows which couldn't be joined,
+	// and why, as newline delimited JSON
+	Rejects io.Writer
+
+	// Resume carries on a join from a checkpoint. The incoming stream has to
+	// be seekable, and the output should already be cut back to the
+	// checkpoint's output offset.
+	Resume *Checkpoint
+
+	// Logger is given the joiner's diagnostics, such as rows which were
+	// skipped because they couldn't be joined. By default, they're written
+	// to the error stream as text, with debug logs only if OutputDebugMode
+	// is set.
+	Logger *slog.Logger
+
+	// CollectMetrics times the joining of each row, and each command run
+	// for RightExecStr, for the histograms given by WriteMetrics
+	CollectMetrics bool
 }
 
 // the 'right' of the join is the index file
 // and is intended to fit into memory map
 // the key of the map is the join key, the
-// data is the rest of the join row.
-type rightIndex map[string]indexEntry
+// data is the rest of the join row. Keys may
+// be repeated in the index file, so each key
+// holds every row found for it, in file order.
+type rightIndex map[string][]*indexEntry
 
+// joinCount is incremented by each worker that matches
+// the entry, so entries are stored as pointers to allow that
+// to be read back once the stream is finished.
+// offset and length are the entry's position in the index file, used
+// to read the row when it's not held in memory, and to emit unmatched
+// rows in a stable order
 type indexEntry struct {
 	data      string
+	offset    int64
+	length    int
 	joinCount int32
+	// the number of other rows in the index file with the same key,
+	// counted on the first entry for the key, including those which
+	// were dropped by the duplicate key policy
+	duplicates int32
 }
@@ -1,59 +1,269 @@
 package smalljoin
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 )
 
-// finds the last newline and separates it out since we can't
-// use a half-written line
-func splitInputBytes(prevRemainder string, data []byte) ([]string, string) {
-	dataString := string(data)
-	cleanBlockIdx := strings.LastIndex(dataString, "\n")
-	if cleanBlockIdx < 0 {
-		return nil, dataString
+// a row of the incoming stream, along with where it was found in the stream
+type record struct {
+	data   string
+	line   int64
+	offset int64
+}
+
+// the line number of the row, for logging, if it's from the incoming stream
+func (r record) lineAttr() slog.Attr {
+	if r.line == 0 {
+		return slog.Attr{}
 	}
-	// a clean block is a block of text which
-	// finishes with newline, it may or may not
-	// start partway thorough an existing line
-	cleanBlock := dataString[0:cleanBlockIdx]
+	return slog.Int64("line", r.line)
+}
 
-	nextRemainder := dataString[cleanBlockIdx:]
-	out := strings.Split(prevRemainder+cleanBlock, "\n")
+// splits the incoming stream up into records as it's read in, keeping track
+// of the line number and byte offset of each of them. Records are usually
+// lines, but for CSVs a newline inside a quoted column doesn't end one.
+type recordSplitter struct {
+	// the partial record left over from the last read
+	remainder string
+	// the line number and byte offset at the start of the remainder
+	line   int64
+	offset int64
 
-	// this will have a leading newline, so remove it
-	nextRemainder = strings.Replace(nextRemainder, "\n", "", 1)
+	// whether to look for CSV quoting, and how it's done
+	quoted bool
+	rules  csvRules
+	// how much of the remainder has already been scanned, and the state
+	// that left it in, so that a long record isn't scanned again with
+	// every read
+	scanned   int
+	midRecord bool
+	midField  bool
+	inQuotes  bool
+	inComment bool
+}
 
-	// remove whitespace on lines while are finished
-	for i := range out {
-		out[i] = strings.TrimSpace(out[i])
+func newRecordSplitter(q QueryOptions, line int64, offset int64) recordSplitter {
+	return recordSplitter{
+		line:   line,
+		offset: offset,
+		quoted: q.isCSV(),
+		rules:  q.csvRules(),
 	}
-	return out, nextRemainder
 }
 
-// streams the input
-func (j *joiner) readInput(inputStream io.ReadCloser) error {
-	var d = make([]byte, defaultInputByteLen)
-	var remainder string
+// finds the ends of the records in what's been read so far, and holds
+// back the last one, since we can't use a half-written record
+func (s *recordSplitter) split(data []byte) []record {
+	s.remainder += string(data)
+	var out []record
+	start := 0
+	i := s.scanned
+scan:
+	for i < len(s.remainder) {
+		if !s.midRecord && s.rules.comment != "" {
+			rest := s.remainder[i:]
+			if len(rest) < len(s.rules.comment) && strings.HasPrefix(s.rules.comment, rest) {
+				// it might be a comment, so wait for the next read
+				break
+			}
+			s.inComment = strings.HasPrefix(rest, s.rules.comment)
+		}
+		s.midRecord = true
+
+		if s.inQuotes {
+			switch s.rules.quotedByte(s.remainder, i, false) {
+			case quotedNeedMore:
+				// it depends on what comes next, so wait for the next read
+				break scan
+			case quotedEscape:
+				i += 2
+			case quotedClose:
+				s.inQuotes = false
+				i++
+			default:
+				// a stray quote inside a quoted column is kept, as with LazyQuotes
+				i++
+			}
+			continue
+		}
+
+		if !s.quoted || s.inComment {
+			next := strings.IndexByte(s.remainder[i:], '\n')
+			if next < 0 {
+				i = len(s.remainder)
+				break
+			}
+			i += next
+		}
+		switch c := s.remainder[i]; {
+		case c == '\n':
+			rec := s.next(s.remainder[start:i], 1)
+			if !s.inComment {
+				out = append(out, rec)
+			}
+			start = i + 1
+			s.midRecord, s.midField, s.inComment = false, false, false
+		case c == s.rules.separator:
+			s.midField = false
+		case c == s.rules.quote:
+			// as with the CSV parser, only a quote at the start of a
+			// column quotes it, otherwise it's just part of the column
+			s.inQuotes = !s.midField
+			s.midField = true
+		case s.rules.trim && !s.midField && (c == ' ' || c == '\t'):
+		default:
+			s.midField = true
+		}
+		i++
+	}
+	s.remainder = s.remainder[start:]
+	s.scanned = i - start
+	return out
+}
+
+// returns whatever's left at the end of the stream. A quoted column which
+// is never closed runs on to the end of the stream, so it ends up here.
+func (s *recordSplitter) flush() []record {
+	if s.remainder == "" {
+		return nil
+	}
+	rec := s.next(s.remainder, 0)
+	comment := s.rules.isComment(s.remainder)
+	s.remainder = ""
+	s.scanned = 0
+	if comment {
+		return nil
+	}
+	return []record{rec}
+}
+
+// makes a record of data, which is followed by a newline unless it's at the
+// end of the stream, and moves on the line number and offset past it
+func (s *recordSplitter) next(data string, newline int) record {
+	rec := record{data: strings.TrimSpace(data), line: s.line, offset: s.offset}
+	s.line += int64(strings.Count(data, "\n") + 1)
+	s.offset += int64(len(data) + newline)
+	return rec
+}
+
+// reads the input in the background, failing the join if it can't be read
+func (j *joiner) startReading(ctx context.Context, inputStream io.ReadCloser) {
+	go func() {
+		if err := j.readInput(ctx, inputStream); err != nil && !errors.Is(err, ctx.Err()) {
+			j.fail(err)
+		}
+	}()
+}
+
+// streams the input, until it's finished or the join is cancelled,
+// closing the incoming channel once it's done
+func (j *joiner) readInput(ctx context.Context, inputStream io.ReadCloser) error {
+	defer close(j.incoming)
 	defer inputStream.Close()
+
+	// closing the input on cancellation unblocks a read which is waiting
+	// on more data, for those inputs which support it, such as pipes
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			inputStream.Close()
+		case <-stop:
+		}
+	}()
+
+	if j.options.LeftQueryOptions.Format == FormatJSON {
+		return j.readJSONInput(ctx, inputStream)
+	}
+
+	var d = make([]byte, defaultInputByteLen)
+	splitter := newRecordSplitter(j.options.LeftQueryOptions, j.startLine+1, j.startOffset)
+	var seq int
 	for {
 		n, err := inputStream.Read(d)
+		if n > 0 {
+			if !j.sendBlock(ctx, block{seq: seq, records: splitter.split(d[:n]), end: splitter.offset, lastLine: splitter.line - 1}) {
+				return ctx.Err()
+			}
+			seq++
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if io.EOF == err {
-			if remainder != "" {
-				j.incoming <- []string{strings.TrimSpace(remainder)}
+			if rest := splitter.flush(); rest != nil {
+				j.sendBlock(ctx, block{seq: seq, records: rest, end: splitter.offset, lastLine: splitter.line - 1})
+			}
+			return nil
+		}
+		if err != nil {
+			return withCategory(ErrorCategoryInput, fmt.Errorf("failed to read incoming stream at byte offset %d: %w", splitter.offset+int64(len(splitter.remainder)), err))
+		}
+	}
+}
+
+// streams JSON which isn't split up by lines, sending its rows on in blocks
+// of around the size that's read at a time for other inputs
+func (j *joiner) readJSONInput(ctx context.Context, inputStream io.Reader) error {
+	r, err := newJSONRecordReader(inputStream, j.options.LeftQueryOptions)
+	if err != nil {
+		return err
+	}
+	var seq, size int
+	var records []record
+	send := func() bool {
+		b := block{seq: seq, records: records, end: r.dec.InputOffset(), lastLine: records[len(records)-1].line}
+		seq++
+		records, size = nil, 0
+		return j.sendBlock(ctx, b)
+	}
+	for {
+		rec, err := r.next()
+		if err == io.EOF {
+			if len(records) > 0 {
+				send()
 			}
-			break
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 		if err != nil {
-			panic(err)
+			return err
 		}
+		records = append(records, rec)
+		size += len(rec.data)
+		// the rows aren't held back while waiting on more of the
+		// input, so a slow stream is joined as it arrives
+		if size >= defaultInputByteLen || !r.buffered() {
+			if !send() {
+				return ctx.Err()
+			}
+		}
+	}
+}
 
-		data, newRemainder := splitInputBytes(remainder, d[:n])
-		remainder = newRemainder
-		j.incoming <- data
+// sends the block to the workers, returning false if
+// the join was cancelled while waiting to do so
+func (j *joiner) sendBlock(ctx context.Context, b block) bool {
+	if j.window != nil {
+		// wait for space in the reorder window
+		select {
+		case j.window <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	select {
+	case j.incoming <- b:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	close(j.incoming)
-	j.moreContent = false
-	j.readWG.Done()
-	return nil
 }
@@ -1,10 +1,10 @@
 package smalljoin
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"strings"
-	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,9 +19,6 @@ func TestParsingIncomingStream(t *testing.T) {
 	if err != nil {
 		t.Fatalf("couldn't open testdata: %v", err)
 	}
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-
 	index := map[string]bool{}
 
 	// build an index to compare against
@@ -41,17 +38,16 @@ func TestParsingIncomingStream(t *testing.T) {
 		streams: streams{
 			input: testdata,
 		},
-		incoming: make(chan []string, 6000),
-		readWG:   wg,
+		incoming: make(chan block, 6000),
 	}
-	err = joiner.readInput(testdata)
+	err = joiner.readInput(context.Background(), testdata)
 	for block := range joiner.incoming {
-		for v := range block {
-			_, ok := index[block[v]]
+		for v := range block.records {
+			_, ok := index[block.records[v].data]
 			if !ok {
 				t.Errorf("Could not find value in index, which might indicate a malformed parse or a mismatch between index and test %q", v)
 			}
-			index[block[v]] = true
+			index[block.records[v].data] = true
 		}
 	}
 	for k, v := range index {
@@ -65,9 +61,6 @@ func TestParsingIncomingStream2(t *testing.T) {
 	if err != nil {
 		t.Fatalf("couldn't open testdata: %v", err)
 	}
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-
 	index := map[string]bool{}
 
 	// build an index to compare against
@@ -86,17 +79,16 @@ func TestParsingIncomingStream2(t *testing.T) {
 		streams: streams{
 			input: testdata,
 		},
-		incoming: make(chan []string, 6000),
-		readWG:   wg,
+		incoming: make(chan block, 6000),
 	}
-	err = joiner.readInput(testdata)
+	err = joiner.readInput(context.Background(), testdata)
 	for block := range joiner.incoming {
-		for v := range block {
-			_, ok := index[block[v]]
+		for v := range block.records {
+			_, ok := index[block.records[v].data]
 			if !ok {
 				t.Errorf("unexpected parsed value: %q", v)
 			}
-			index[block[v]] = true
+			index[block.records[v].data] = true
 		}
 	}
 	for k, v := range index {
@@ -106,3 +98,27 @@ func TestParsingIncomingStream2(t *testing.T) {
 	}
 	assert.NoError(t, err)
 }
+
+// the line numbers and offsets of each row should point back at where it is in the stream
+func TestParsingIncomingStreamPositions(t *testing.T) {
+	data, err := ioutil.ReadFile("internal/testdata/testdata_2")
+	if err != nil {
+		t.Fatalf("couldn't open testdata: %v", err)
+	}
+	lines := strings.Split(string(data), "\n")
+
+	joiner := joiner{
+		incoming: make(chan block, 6000),
+	}
+	err = joiner.readInput(context.Background(), ioutil.NopCloser(strings.NewReader(string(data))))
+	assert.NoError(t, err)
+	var count int
+	for block := range joiner.incoming {
+		for _, rec := range block.records {
+			count++
+			assert.Equal(t, lines[rec.line-1], string(data[rec.offset:rec.offset+int64(len(lines[rec.line-1]))]))
+			assert.Equal(t, strings.TrimSpace(lines[rec.line-1]), rec.data)
+		}
+	}
+	assert.True(t, count > 0)
+}
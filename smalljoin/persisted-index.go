@@ -0,0 +1,202 @@
+package smalljoin
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const persistedIndexMagic = "small-join index\n"
+
+// the version of persistedIndex, which has to be bumped whenever it changes,
+// including the QueryOptions in it, as gob quietly decodes an older index
+// with zero values for anything which has been added since
+const persistedIndexVersion = 3
+
+// the prebuilt index file's contents, it's written out as the magic string
+// followed by the gob encoding of this struct
+type persistedIndex struct {
+	Version        int
+	Source         string
+	SourceSize     int64
+	SourceModTime  time.Time
+	SourceChecksum []byte
+	QueryOptions   QueryOptions
+	HeaderColumns  []string
+	Duplicates     DuplicateKeyPolicy
+	Keys           map[string][]persistedIndexEntry
+	Bloom          *bloomFilter
+}
+
+type persistedIndexEntry struct {
+	Offset     int64
+	Length     int
+	Duplicates int32
+}
+
+// BuildIndexFile reads the index file at source and writes out a prebuilt index
+// of it to dest, containing the keys and the offsets of their rows in the source
+// file. This can then be loaded with Options.PrebuiltIndex rather than parsing
+// the source file again on each run. If bloomFalsePositiveRate is set, a bloom
+// filter of the keys is built and stored in the index as well.
+func BuildIndexFile(source string, dest string, queryOptions QueryOptions, duplicates DuplicateKeyPolicy, bloomFalsePositiveRate float64) error {
+	if err := validateBloomFalsePositiveRate(bloomFalsePositiveRate); err != nil {
+		return err
+	}
+	if err := queryOptions.validateFormat("right"); err != nil {
+		return err
+	}
+	if err := queryOptions.Dialect.validate(queryOptions.Separator); err != nil {
+		return fmt.Errorf("invalid CSV dialect: %w", err)
+	}
+	if queryOptions.sniffed() {
+		var err error
+		queryOptions, err = sniffIndexFile(source, queryOptions, nil)
+		if err != nil {
+			return fmt.Errorf("failed to detect the format of the index file: %w", err)
+		}
+	}
+	if len(queryOptions.JoinColumnNames) > 0 && !queryOptions.Header {
+		return fmt.Errorf("join columns can only be given by name when the index file has a header")
+	}
+	if queryOptions.Header {
+		headerRow, err := readIndexFileHeader(source)
+		if err != nil {
+			return fmt.Errorf("failed to read header of index file: %w", err)
+		}
+		queryOptions, err = queryOptions.withHeader(headerRow)
+		if err != nil {
+			return fmt.Errorf("failed to parse header of index file: %w", err)
+		}
+	}
+	index, err := createIndexMap(source, queryOptions, duplicates, IndexOnDisk, 0)
+	if err != nil {
+		return fmt.Errorf("failed to parse index: %w", err)
+	}
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	size, checksum, err := checksumFile(source)
+	if err != nil {
+		return err
+	}
+
+	p := persistedIndex{
+		Version:        persistedIndexVersion,
+		Source:         absSource,
+		SourceSize:     size,
+		SourceModTime:  info.ModTime(),
+		SourceChecksum: checksum,
+		QueryOptions:   queryOptions,
+		HeaderColumns:  queryOptions.header,
+		Duplicates:     duplicates,
+		Keys:           make(map[string][]persistedIndexEntry, len(index)),
+	}
+	for k, entries := range index {
+		for _, e := range entries {
+			p.Keys[k] = append(p.Keys[k], persistedIndexEntry{Offset: e.offset, Length: e.length, Duplicates: e.duplicates})
+		}
+	}
+	if bloomFalsePositiveRate > 0 {
+		p.Bloom = newBloomFilterForIndex(index, bloomFalsePositiveRate)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(persistedIndexMagic)
+	if err := gob.NewEncoder(w).Encode(p); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadIndexFile(path string) (*persistedIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(persistedIndexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != persistedIndexMagic {
+		return nil, fmt.Errorf("%q is not a small-join index file", path)
+	}
+	var p persistedIndex
+	if err := gob.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to read index file %q: %w", path, err)
+	}
+	if p.Version != persistedIndexVersion {
+		return nil, fmt.Errorf("index file %q is version %d, expected version %d", path, p.Version, persistedIndexVersion)
+	}
+	p.QueryOptions.header = p.HeaderColumns
+	return &p, nil
+}
+
+// checks the source file the index was built from hasn't changed since. Its
+// size and modification time are quick to check, but the checksum means
+// reading the whole file, so it's only checked when asked for. That also
+// allows for a copy of the source, which has a different modification time.
+func (p *persistedIndex) verifySource(source string, checksum bool) error {
+	changed := fmt.Errorf("index file source %q has changed since the index was built", source)
+	if checksum {
+		size, sum, err := checksumFile(source)
+		if err != nil {
+			return err
+		}
+		if size != p.SourceSize || !bytes.Equal(sum, p.SourceChecksum) {
+			return changed
+		}
+		return nil
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.Size() != p.SourceSize || !info.ModTime().Equal(p.SourceModTime) {
+		return fmt.Errorf("%w, going by its size and modification time", changed)
+	}
+	return nil
+}
+
+func (p *persistedIndex) rightIndex() rightIndex {
+	out := make(rightIndex, len(p.Keys))
+	for k, entries := range p.Keys {
+		for _, e := range entries {
+			out[k] = append(out[k], &indexEntry{offset: e.Offset, length: e.Length, duplicates: e.Duplicates})
+		}
+	}
+	return out
+}
+
+func checksumFile(path string) (int64, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, h.Sum(nil), nil
+}
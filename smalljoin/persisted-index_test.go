@@ -0,0 +1,90 @@
+package smalljoin
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrebuiltIndex(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "index.csv")
+	dest := filepath.Join(dir, "index.idx")
+
+	data, err := ioutil.ReadFile("internal/testdata/index_5")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(source, data, 0644))
+
+	err = BuildIndexFile(source, dest, QueryOptions{
+		Separator:       ",",
+		Header:          true,
+		JoinColumnNames: []string{"customer_id"},
+	}, DuplicateKeysAll, 0.01)
+	assert.NoError(t, err)
+
+	run := func(o Options) (string, error) {
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		errStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		inputStream, err := os.Open("internal/testdata/testdata_5")
+		if err != nil {
+			t.FailNow()
+		}
+		err = New(inputStream, outStream, errStream, o).Run()
+		return outStream.String(), err
+	}
+
+	options := Options{
+		Jointype:               JoinTypeRight,
+		PrebuiltIndex:          dest,
+		BloomFalsePositiveRate: 0.01,
+		LeftQueryOptions: QueryOptions{
+			Separator:  ",",
+			JoinColumn: 2,
+			Header:     true,
+		},
+	}
+
+	out, err := run(options)
+	assert.NoError(t, err)
+	sortAndCompare(t, `
+{"Left":null,"Right":{"IndexFileResult":{"Index":"c9","Row":"c9,bronze","Fields":{"customer_id":"c9","tier":"bronze"}}}}
+{"Left":{"Index":"c1","Row":"1,alice,c1","Fields":{"customer_id":"c1","id":"1","name":"alice"}},"Right":{"IndexFileResult":{"Index":"c1","Row":"c1,gold","Fields":{"customer_id":"c1","tier":"gold"}}}}
+{"Left":{"Index":"c3","Row":"3,carol,c3","Fields":{"customer_id":"c3","id":"3","name":"carol"}},"Right":{"IndexFileResult":{"Index":"c3","Row":"c3,silver","Fields":{"customer_id":"c3","tier":"silver"}}}}
+	`, []byte(out))
+
+	// touching the source is enough for it to look stale, unless its checksum is checked
+	later := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(source, later, later))
+	_, err = run(options)
+	assert.Error(t, err)
+	options.VerifyIndexChecksum = true
+	_, err = run(options)
+	assert.NoError(t, err)
+
+	// once the source changes, the index is stale and shouldn't be used
+	assert.NoError(t, ioutil.WriteFile(source, append(data, []byte("c2,gold\n")...), 0644))
+	_, err = run(options)
+	assert.Error(t, err)
+
+	options.AllowStaleIndex = true
+	_, err = run(options)
+	assert.NoError(t, err)
+}
+
+func TestPrebuiltIndexVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.idx")
+	var buf bytes.Buffer
+	buf.WriteString(persistedIndexMagic)
+	assert.NoError(t, gob.NewEncoder(&buf).Encode(persistedIndex{Version: 1, Source: "index.csv"}))
+	assert.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+
+	_, err := loadIndexFile(path)
+	assert.EqualError(t, err, fmt.Sprintf("index file %q is version 1, expected version %d", path, persistedIndexVersion))
+}
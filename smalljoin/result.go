@@ -1,6 +1,9 @@
 package smalljoin
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 // 'Left' is the streaming side input value which was attempted to be
 // matched and its indexes.
@@ -12,9 +15,15 @@ import "encoding/json"
 // assuming that the index key is the second column
 // then the entire 'row' contentents are "a, b, c"
 // and the "index" is "b"
+//
+// 'Fields' labels each column of the row when the input has a header
 type LeftResult struct {
-	Index string
-	Row   string
+	Index  string
+	Row    string
+	Fields map[string]string `json:",omitempty"`
+
+	// the row is JSON, and is output as it is rather than as a string
+	rowJSON bool
 }
 
 // Right is either the input side or whatever side that's being
@@ -26,8 +35,44 @@ type RightResult struct {
 }
 
 type IndexFileResult struct {
-	Index string // index is the thign that was attempted to be matched on
-	Row   string // Row is the entire contents of the row from the matched result
+	Index  string            // index is the thign that was attempted to be matched on
+	Row    string            // Row is the entire contents of the row from the matched result
+	Fields map[string]string `json:",omitempty"` // Fields are the columns of the row, labelled by the index file's header
+
+	rowJSON bool
+}
+
+// the results with a row of JSON embed it, so it doesn't have to be decoded twice
+type resultWithJSONRow struct {
+	Index  string
+	Row    json.RawMessage
+	Fields map[string]string `json:",omitempty"`
+}
+
+func (l LeftResult) MarshalJSON() ([]byte, error) {
+	if l.rowJSON {
+		return json.Marshal(resultWithJSONRow{Index: l.Index, Row: json.RawMessage(l.Row), Fields: l.Fields})
+	}
+	type plain LeftResult
+	return json.Marshal(plain(l))
+}
+
+func (r IndexFileResult) MarshalJSON() ([]byte, error) {
+	if r.rowJSON {
+		return json.Marshal(resultWithJSONRow{Index: r.Index, Row: json.RawMessage(r.Row), Fields: r.Fields})
+	}
+	type plain IndexFileResult
+	return json.Marshal(plain(r))
+}
+
+// the left side of a result, for a row of the incoming stream
+func (q QueryOptions) leftResult(key string, row string) *LeftResult {
+	return &LeftResult{Index: key, Row: row, Fields: q.labelFields(row), rowJSON: q.Format != FormatDelimited}
+}
+
+// the right side of a result, for a row of the index file
+func (q QueryOptions) indexFileResult(key string, row string) *IndexFileResult {
+	return &IndexFileResult{Index: key, Row: row, Fields: q.labelFields(row), rowJSON: q.Format != FormatDelimited}
 }
 
 type ExecResult struct {
@@ -41,11 +86,35 @@ type Result struct {
 	Right *RightResult
 }
 
+// the result as a line of JSON, which can fail if a row of JSON that's
+// embedded as it was written turns out not to be valid
+func (r Result) marshal() ([]byte, error) {
+	d, err := json.Marshal(r)
+	if err != nil {
+		return nil, withCategory(ErrorCategoryJSON, fmt.Errorf("failed to write out the result for key %q: %w", r.key(), err))
+	}
+	return d, nil
+}
+
 func (r Result) String() string {
-	d, _ := json.Marshal(r)
+	d, err := r.marshal()
+	if err != nil {
+		return fmt.Sprintf("%%!(%v)", err)
+	}
 	return string(d)
 }
 
+// the key which the result was joined on
+func (r Result) key() string {
+	if r.Left != nil {
+		return r.Left.Index
+	}
+	if r.Right != nil && r.Right.IndexFileResult != nil {
+		return r.Right.IndexFileResult.Index
+	}
+	return ""
+}
+
 func (r Result) SuccessfulJoin(joinType Jointype) bool {
 	switch joinType {
 	case JoinTypeLeft:
@@ -63,6 +132,15 @@ func (r Result) SuccessfulJoin(joinType Jointype) bool {
 		if r.Right.ExecResult != nil {
 			return r.Right.ExecResult.ExitCode != 0
 		}
+	case JoinTypeRight:
+		return r.Right != nil && r.Right.IndexFileResult != nil
+	case JoinTypeFull:
+		if r.Left != nil {
+			return true
+		}
+		return r.Right != nil && r.Right.IndexFileResult != nil
+	case JoinTypeLeftIsNull:
+		return r.Left == nil && r.Right != nil && r.Right.IndexFileResult != nil
 	case JoinTypeInner:
 		if r.Left == nil || r.Right == nil {
 			return false
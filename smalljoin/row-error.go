@@ -0,0 +1,114 @@
+package smalljoin
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RowError is returned when a row of the incoming stream couldn't be joined,
+// giving where the row was found so that it can be tracked down
+type RowError struct {
+	// the line number of the row in the incoming stream, counting the header
+	Line int64
+	// the byte offset of the start of the row in the incoming stream
+	Offset int64
+	Row    string
+	Err    error
+
+	// the worker which was joining the row, from 1, if it was joined by one
+	worker int
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d (byte offset %d): %v, original data: %q", e.Line, e.Offset, e.Err, e.Row)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// the fields to log about the row
+func (e *RowError) logAttrs() []any {
+	attrs := []any{"line", e.Line, "offset", e.Offset, "category", ErrorCategory(e.Err), "error", e.Err.Error()}
+	if e.worker > 0 {
+		attrs = append(attrs, "worker", e.worker)
+	}
+	return attrs
+}
+
+func newRowError(r record, err error) *RowError {
+	return &RowError{Line: r.line, Offset: r.offset, Row: r.data, Err: err}
+}
+
+// ErrorBudgetExceeded is returned when more rows couldn't be
+// joined than MaxErrors or MaxErrorRate allow for
+type ErrorBudgetExceeded struct {
+	Errored   int64
+	LinesRead int64
+}
+
+func (e *ErrorBudgetExceeded) Error() string {
+	return fmt.Sprintf("error budget exceeded: %d of the %d rows read couldn't be joined", e.Errored, e.LinesRead)
+}
+
+// a row which couldn't be joined, as it's written to the rejects
+type rejectedRow struct {
+	Line   int64  `json:"line"`
+	Offset int64  `json:"offset"`
+	Row    string `json:"row"`
+	Error  string `json:"error"`
+}
+
+// the error rate isn't checked until this many rows have been read,
+// so that a bad row near the start doesn't stop the join by itself
+const minRowsForErrorRate = 1000
+
+func (o Options) validateErrorBudget() error {
+	if o.MaxErrors != nil && *o.MaxErrors < 0 {
+		return fmt.Errorf("not a valid max errors %d, it needs to be 0 or more", *o.MaxErrors)
+	}
+	if !(o.MaxErrorRate >= 0 && o.MaxErrorRate <= 1) {
+		return fmt.Errorf("not a valid max error rate %v, it needs to be between 0 and 1", o.MaxErrorRate)
+	}
+	return nil
+}
+
+// whether a row which couldn't be joined can be skipped over
+func (j *joiner) toleratesRowErrors() bool {
+	return j.options.ContinueOnErr || j.options.MaxErrors != nil || j.options.MaxErrorRate > 0
+}
+
+// checks the number of rows which couldn't be joined against the budget.
+// The error rate is only checked part way through once enough rows have
+// been read for it to mean something, but always at the end of the join.
+func (j *joiner) checkErrorBudget(errored int64, finished bool) error {
+	linesRead := j.stats.snapshot().LinesRead
+	exceeded := j.options.MaxErrors != nil && errored > *j.options.MaxErrors
+	if j.options.MaxErrorRate > 0 && linesRead > 0 && (finished || linesRead >= minRowsForErrorRate) {
+		exceeded = exceeded || float64(errored)/float64(linesRead) > j.options.MaxErrorRate
+	}
+	if exceeded {
+		return &ErrorBudgetExceeded{Errored: errored, LinesRead: linesRead}
+	}
+	return nil
+}
+
+// writes out a row which couldn't be joined, so it can be fixed and joined again later
+func (j *joiner) reject(rowErr *RowError) error {
+	if j.options.Rejects == nil {
+		return nil
+	}
+	data, err := json.Marshal(rejectedRow{
+		Line:   rowErr.Line,
+		Offset: rowErr.Offset,
+		Row:    rowErr.Row,
+		Error:  rowErr.Err.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := j.options.Rejects.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write rejected row: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package smalljoin
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SeparatorAuto as a separator detects the separator, how columns are quoted
+// and whether there's a header from the first rows of the input
+const SeparatorAuto = "auto"
+
+// how much of the input is looked at to detect its format
+const sniffLines = 100
+const sniffBytes = 64 * 1024
+
+// the separators which are detected, with those which are less likely
+// to turn up in the columns themselves first, as they win ties
+var sniffSeparators = []string{"\t", ";", "|", ","}
+
+const sniffSeparatorChars = "\t;|,"
+
+// the format detected for an input with SeparatorAuto
+type sniffedFormat struct {
+	separator string
+	quote     rune
+	escape    QuoteEscape
+	header    bool
+}
+
+func (f sniffedFormat) logAttrs() []any {
+	escape := "default"
+	switch f.escape {
+	case EscapeDoubled:
+		escape = "doubled"
+	case EscapeBackslash:
+		escape = "backslash"
+	}
+	return []any{"separator", f.separator, "quote", string(f.quote), "escape", escape, "header", f.header}
+}
+
+// detects the format of the input from a sample of its first lines,
+// skipping any which are empty or comments
+func sniffFormat(lines []string, comment string) sniffedFormat {
+	var sample []string
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" || (comment != "" && strings.HasPrefix(line, comment)) {
+			continue
+		}
+		sample = append(sample, line)
+	}
+
+	f := sniffedFormat{separator: ",", quote: sniffQuote(sample)}
+	var best float64
+	var bestColumns int
+	for _, separator := range sniffSeparators {
+		rules := csvRules{separator: separator[0], quote: byte(f.quote)}
+		consistency, columns := columnConsistency(sample, rules)
+		if columns > 1 && consistency > best {
+			f.separator, best, bestColumns = separator, consistency, columns
+		}
+	}
+	f.escape = sniffEscape(sample, f.separator[0], byte(f.quote))
+	if bestColumns > 1 {
+		f.header = sniffHeader(sample, csvRules{separator: f.separator[0], quote: byte(f.quote), backslash: f.escape == EscapeBackslash})
+	}
+	return f
+}
+
+// how many of the lines have the most common number of columns, and what that is
+func columnConsistency(lines []string, rules csvRules) (float64, int) {
+	if len(lines) == 0 {
+		return 0, 0
+	}
+	counts := map[int]int{}
+	for _, line := range lines {
+		columns, _ := rules.split(line)
+		counts[len(columns)]++
+	}
+	var mode, modeCount int
+	for columns, n := range counts {
+		if n > modeCount || (n == modeCount && columns > mode) {
+			mode, modeCount = columns, n
+		}
+	}
+	return float64(modeCount) / float64(len(lines)), mode
+}
+
+// picks whichever of " or ' more often opens or closes a column
+func sniffQuote(lines []string) rune {
+	quotedColumns := func(quote byte) int {
+		n := 0
+		for _, line := range lines {
+			for i := 0; i < len(line); i++ {
+				if line[i] != quote {
+					continue
+				}
+				opens := i == 0 || strings.IndexByte(sniffSeparatorChars, line[i-1]) >= 0
+				closes := i == len(line)-1 || strings.IndexByte(sniffSeparatorChars, line[i+1]) >= 0
+				if opens || closes {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if quotedColumns('\'') > quotedColumns('"') {
+		return '\''
+	}
+	return '"'
+}
+
+// looks for quotes escaped with backslashes, or doubled up in the middle of a column
+func sniffEscape(lines []string, separator byte, quote byte) QuoteEscape {
+	var backslashed, doubled int
+	for _, line := range lines {
+		for i := 1; i < len(line); i++ {
+			if line[i] != quote {
+				continue
+			}
+			switch {
+			case line[i-1] == '\\':
+				backslashed++
+			case line[i-1] == quote && i >= 2 && line[i-2] != separator && i+1 < len(line) && line[i+1] != separator:
+				// not an empty quoted column
+				doubled++
+				i++
+			}
+		}
+	}
+	switch {
+	case backslashed > 0 && doubled == 0:
+		return EscapeBackslash
+	case doubled > 0 && backslashed == 0:
+		return EscapeDoubled
+	}
+	return EscapeDefault
+}
+
+// guesses whether the first line is a header, by whether it stands out from
+// the rest of each column: a column which is otherwise all numbers, or all
+// the same length, is a vote for a header if the first line's isn't
+func sniffHeader(lines []string, rules csvRules) bool {
+	// a single row has nothing to stand out from
+	if len(lines) < 3 {
+		return false
+	}
+	rows := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		columns, _ := rules.split(line)
+		rows = append(rows, columns)
+	}
+	votes := 0
+	for col := range rows[0] {
+		first := strings.TrimSpace(rows[0][col])
+		numeric, sameLength := true, true
+		length := -1
+		seen := 0
+		for _, row := range rows[1:] {
+			if col >= len(row) {
+				continue
+			}
+			value := strings.TrimSpace(row[col])
+			seen++
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				numeric = false
+			}
+			if length >= 0 && len(value) != length {
+				sameLength = false
+			}
+			length = len(value)
+		}
+		if seen == 0 {
+			continue
+		}
+		switch {
+		case numeric:
+			if _, err := strconv.ParseFloat(first, 64); err != nil {
+				votes++
+			} else {
+				votes--
+			}
+		case sameLength:
+			if len(first) != length {
+				votes++
+			} else {
+				votes--
+			}
+		}
+	}
+	return votes > 0
+}
+
+// whether the format is to be detected, which is only
+// done for delimited rows, as JSON has no separator
+func (q QueryOptions) sniffed() bool {
+	return q.Separator == SeparatorAuto && q.Format == FormatDelimited
+}
+
+// the query options with the format which was detected filled in. Anything
+// given explicitly in the dialect, or the header if it was given, is kept.
+func (q QueryOptions) withSniffedFormat(f sniffedFormat) QueryOptions {
+	q.Separator = f.separator
+	if q.Dialect.Quote == 0 {
+		q.Dialect.Quote = f.quote
+	}
+	if q.Dialect.Escape == EscapeDefault {
+		q.Dialect.Escape = f.escape
+	}
+	if !q.HeaderGiven {
+		q.Header = q.Header || f.header
+	}
+	return q
+}
+
+// detects the format of the incoming stream from its first lines, which are
+// peeked at in r without consuming them. It only waits for as much of the
+// stream as it needs, so that a slow stream is joined as soon as sniffLines
+// lines have arrived, rather than once sniffBytes have.
+func sniffStream(r *bufio.Reader, q QueryOptions, logger *slog.Logger) (QueryOptions, error) {
+	var buf []byte
+	ended := false
+	for {
+		// everything which has been read so far, which doesn't wait
+		buf, _ = r.Peek(r.Buffered())
+		if bytes.Count(buf, []byte("\n")) >= sniffLines || len(buf) >= sniffBytes {
+			break
+		}
+		// waits for the next read of the stream, however much it is
+		_, err := r.Peek(len(buf) + 1)
+		if errors.Is(err, io.EOF) {
+			buf, _ = r.Peek(r.Buffered())
+			ended = true
+			break
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			break
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	lines := strings.Split(string(buf), "\n")
+	if !ended && len(lines) > 1 {
+		// the last line may have been cut short
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > sniffLines {
+		lines = lines[:sniffLines]
+	}
+	f := sniffFormat(lines, q.Dialect.Comment)
+	logger.Debug("detected the format of the incoming stream", f.logAttrs()...)
+	return q.withSniffedFormat(f), nil
+}
+
+// detects the format of the index file from its first lines
+func sniffIndexFile(path string, q QueryOptions, logger *slog.Logger) (QueryOptions, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return q, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, sniffBytes), sniffBytes)
+	for len(lines) < sniffLines && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return q, err
+	}
+	sniffed := sniffFormat(lines, q.Dialect.Comment)
+	if logger != nil {
+		logger.Debug("detected the format of the index file", sniffed.logAttrs()...)
+	}
+	return q.withSniffedFormat(sniffed), nil
+}
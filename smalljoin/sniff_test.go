@@ -0,0 +1,167 @@
+package smalljoin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffFormat(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		comment  string
+		expected sniffedFormat
+	}{
+		"a CSV with a header": {
+			input:    "id,name,amount\n1,alice,10.5\n2,bob,3\n3,\"carol, jr\",7\n",
+			expected: sniffedFormat{separator: ",", quote: '"', header: true},
+		},
+		"a CSV without a header": {
+			input:    "1,alice,10.5\n2,bob,3\n3,carol,7\n",
+			expected: sniffedFormat{separator: ",", quote: '"'},
+		},
+		"tab separated, with commas in the columns": {
+			input:    "a, b\tc\td\ne, f\tg\th\n",
+			expected: sniffedFormat{separator: "\t", quote: '"'},
+		},
+		"semicolons with decimal commas": {
+			input:    "name;price\nwidget;1,50\ngadget;22,00\n",
+			expected: sniffedFormat{separator: ";", quote: '"', header: true},
+		},
+		"pipes, with a header of fixed length codes": {
+			input:    "product_code|description\nAB12|first thing\nCD34|second\n",
+			expected: sniffedFormat{separator: "|", quote: '"', header: true},
+		},
+		"single quotes": {
+			input:    "'a|b','it''s'\n'c','d'\n",
+			expected: sniffedFormat{separator: ",", quote: '\'', escape: EscapeDoubled},
+		},
+		"backslash escaped quotes": {
+			input:    "1,\"say \\\"hi\\\"\"\n2,\"x\"\n",
+			expected: sniffedFormat{separator: ",", quote: '"', escape: EscapeBackslash},
+		},
+		"comments are ignored": {
+			input:    "# exported; from somewhere; else\n1;2\n3;4\n",
+			comment:  "#",
+			expected: sniffedFormat{separator: ";", quote: '"'},
+		},
+		"a single column": {
+			input:    "a\nb\nc\n",
+			expected: sniffedFormat{separator: ",", quote: '"'},
+		},
+	}
+
+	for name, td := range tests {
+		assert.Equal(t, td.expected, sniffFormat(strings.Split(td.input, "\n"), td.comment), name)
+	}
+}
+
+func TestSniffStreamLeavesTheStreamToBeRead(t *testing.T) {
+	input := "id\tname\n1\tx\n2\ty\n"
+	r := bufio.NewReaderSize(strings.NewReader(input), sniffBytes)
+	q, err := sniffStream(r, QueryOptions{Separator: SeparatorAuto, JoinColumn: 1}, NewLogger(ioutil.Discard, LogFormatText, slog.LevelInfo))
+	assert.NoError(t, err)
+	assert.Equal(t, "\t", q.Separator)
+	assert.True(t, q.Header)
+	rest, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, input, string(rest))
+}
+
+func TestSniffStreamDoesntWaitForMoreThanItNeeds(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		// a line at a time, and then the stream stays open
+		for i := 0; i < sniffLines; i++ {
+			fmt.Fprintf(pw, "%d;row %d\n", i, i)
+		}
+	}()
+
+	done := make(chan QueryOptions)
+	go func() {
+		q, err := sniffStream(bufio.NewReaderSize(pr, sniffBytes), QueryOptions{Separator: SeparatorAuto, JoinColumn: 1}, NewLogger(ioutil.Discard, LogFormatText, slog.LevelInfo))
+		assert.NoError(t, err)
+		done <- q
+	}()
+	select {
+	case q := <-done:
+		assert.Equal(t, ";", q.Separator)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the format wasn't detected until more of the stream arrived")
+	}
+}
+
+func TestAutoSeparatorJoin(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "index")
+	assert.NoError(t, ioutil.WriteFile(indexFile, []byte("code|label\nAB|first\nCD|second\n"), 0644))
+	input := "id;code;note\n1;AB;\"x;y\"\n2;ZZ;z\n3;CD;w\n"
+
+	expected := Result{
+		Left:  &LeftResult{Index: "AB", Row: "1;AB;\"x;y\"", Fields: map[string]string{"id": "1", "code": "AB", "note": "x;y"}},
+		Right: &RightResult{IndexFileResult: &IndexFileResult{Index: "AB", Row: "AB|first", Fields: map[string]string{"code": "AB", "label": "first"}}},
+	}.String() + "\n" + Result{
+		Left:  &LeftResult{Index: "CD", Row: "3;CD;w", Fields: map[string]string{"id": "3", "code": "CD", "note": "w"}},
+		Right: &RightResult{IndexFileResult: &IndexFileResult{Index: "CD", Row: "CD|second", Fields: map[string]string{"code": "CD", "label": "second"}}},
+	}.String() + "\n"
+
+	tests := map[string]struct {
+		left  QueryOptions
+		right QueryOptions
+	}{
+		"by position": {
+			left:  QueryOptions{Separator: SeparatorAuto, JoinColumn: 1},
+			right: QueryOptions{Separator: SeparatorAuto, JoinColumn: 0},
+		},
+		// the header is only known to be there once it's been detected
+		"by name": {
+			left:  QueryOptions{Separator: SeparatorAuto, JoinColumnNames: []string{"code"}},
+			right: QueryOptions{Separator: SeparatorAuto, JoinColumnNames: []string{"code"}},
+		},
+	}
+	for name, test := range tests {
+		outStream := createNoopWriteCloser(bytes.NewBuffer(nil))
+		j := New(ioutil.NopCloser(strings.NewReader(input)), outStream, createNoopWriteCloser(bytes.NewBuffer(nil)), Options{
+			Jointype:          JoinTypeInner,
+			IndexFile:         indexFile,
+			PreserveOrder:     true,
+			LeftQueryOptions:  test.left,
+			RightQueryOptions: test.right,
+		})
+		assert.NoError(t, j.Run(), name)
+		assert.Equal(t, expected, outStream.String(), name)
+	}
+}
+
+func TestWithSniffedFormat(t *testing.T) {
+	sniffed := sniffedFormat{separator: ";", quote: '\'', escape: EscapeDoubled, header: true}
+	tests := map[string]struct {
+		q        QueryOptions
+		expected QueryOptions
+	}{
+		"all detected": {
+			q:        QueryOptions{Separator: SeparatorAuto},
+			expected: QueryOptions{Separator: ";", Header: true, Dialect: CSVDialect{Quote: '\'', Escape: EscapeDoubled}},
+		},
+		"a dialect given": {
+			q:        QueryOptions{Separator: SeparatorAuto, Dialect: CSVDialect{Quote: '"', Escape: EscapeBackslash}},
+			expected: QueryOptions{Separator: ";", Header: true, Dialect: CSVDialect{Quote: '"', Escape: EscapeBackslash}},
+		},
+		"no header given": {
+			q:        QueryOptions{Separator: SeparatorAuto, HeaderGiven: true},
+			expected: QueryOptions{Separator: ";", HeaderGiven: true, Dialect: CSVDialect{Quote: '\'', Escape: EscapeDoubled}},
+		},
+	}
+	for name, test := range tests {
+		assert.Equal(t, test.expected, test.q.withSniffedFormat(sniffed), name)
+	}
+}
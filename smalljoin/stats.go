@@ -0,0 +1,202 @@
+package smalljoin
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a summary of the join, and how far through the incoming stream it got
+type Stats struct {
+	// rows of the incoming stream which were read and joined
+	LinesRead int64 `json:"lines_read"`
+	// rows which had no key to join on
+	EmptyKey int64 `json:"empty_key"`
+	// rows which were joined to at least one row on the right
+	Matched int64 `json:"matched"`
+	// rows with a key which weren't joined to anything on the right
+	Unmatched int64 `json:"unmatched"`
+	// rows which couldn't be joined, in total and by ErrorCategory
+	Errored          int64            `json:"errored"`
+	ErrorsByCategory map[string]int64 `json:"errors_by_category,omitempty"`
+	// an estimate of the number of distinct keys in the incoming stream
+	DistinctKeys int64 `json:"distinct_keys"`
+	// the byte offset in the incoming stream up to which every row has
+	// been joined and written out. Some of the rows after it may have
+	// been written out as well, as blocks of rows finish out of order.
+	LastOffset int64 `json:"last_offset"`
+
+	// the number of keys and rows in the index, and how many of
+	// the keys are found on more than one row of the index file
+	IndexKeys          int64 `json:"index_keys"`
+	IndexRows          int64 `json:"index_rows"`
+	DuplicateIndexKeys int64 `json:"duplicate_index_keys"`
+
+	// how long the join has been running for, or took
+	Elapsed time.Duration `json:"elapsed_ns"`
+}
+
+// RowsPerSecond is the rate at which the rows of the incoming stream were joined
+func (s Stats) RowsPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.LinesRead) / s.Elapsed.Seconds()
+}
+
+// BytesPerSecond is the rate at which the incoming stream was joined
+func (s Stats) BytesPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.LastOffset) / s.Elapsed.Seconds()
+}
+
+// the counters behind Stats, which are updated by the workers as they go
+type joinStats struct {
+	linesRead  int64
+	emptyKey   int64
+	matched    int64
+	unmatched  int64
+	errored    int64
+	lastOffset int64
+	keys       *hyperLogLog
+
+	indexKeys          int64
+	indexRows          int64
+	duplicateIndexKeys int64
+
+	lock             sync.Mutex
+	errorsByCategory map[string]int64
+	started          time.Time
+	finished         time.Time
+}
+
+func newJoinStats() joinStats {
+	return joinStats{keys: newHyperLogLog(), errorsByCategory: map[string]int64{}}
+}
+
+func (s *joinStats) snapshot() Stats {
+	stats := Stats{
+		LinesRead:          atomic.LoadInt64(&s.linesRead),
+		EmptyKey:           atomic.LoadInt64(&s.emptyKey),
+		Matched:            atomic.LoadInt64(&s.matched),
+		Unmatched:          atomic.LoadInt64(&s.unmatched),
+		Errored:            atomic.LoadInt64(&s.errored),
+		LastOffset:         atomic.LoadInt64(&s.lastOffset),
+		IndexKeys:          atomic.LoadInt64(&s.indexKeys),
+		IndexRows:          atomic.LoadInt64(&s.indexRows),
+		DuplicateIndexKeys: atomic.LoadInt64(&s.duplicateIndexKeys),
+	}
+	if s.keys != nil {
+		stats.DistinctKeys = s.keys.estimate()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.errorsByCategory) > 0 {
+		stats.ErrorsByCategory = make(map[string]int64, len(s.errorsByCategory))
+		for category, n := range s.errorsByCategory {
+			stats.ErrorsByCategory[category] = n
+		}
+	}
+	switch {
+	case !s.finished.IsZero():
+		stats.Elapsed = s.finished.Sub(s.started)
+	case !s.started.IsZero():
+		stats.Elapsed = time.Since(s.started)
+	}
+	return stats
+}
+
+func (s *joinStats) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.started = time.Now()
+}
+
+func (s *joinStats) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.finished = time.Now()
+}
+
+// counts a row of the incoming stream, once it's been joined
+func (s *joinStats) rowJoined(key string, matched bool) {
+	atomic.AddInt64(&s.linesRead, 1)
+	switch {
+	case key == "":
+		atomic.AddInt64(&s.emptyKey, 1)
+		return
+	case matched:
+		atomic.AddInt64(&s.matched, 1)
+	default:
+		atomic.AddInt64(&s.unmatched, 1)
+	}
+	if s.keys != nil {
+		s.keys.add(key)
+	}
+}
+
+func (s *joinStats) rowErrored(category string) {
+	atomic.AddInt64(&s.linesRead, 1)
+	atomic.AddInt64(&s.errored, 1)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.errorsByCategory != nil {
+		s.errorsByCategory[category]++
+	}
+}
+
+// counts the keys and rows of the index, or a part of it
+func (s *joinStats) indexLoaded(index rightIndex) {
+	var rows, duplicates int64
+	for _, entries := range index {
+		rows += int64(len(entries))
+		if len(entries) > 0 && entries[0].duplicates > 0 {
+			duplicates++
+		}
+	}
+	atomic.AddInt64(&s.indexKeys, int64(len(index)))
+	atomic.AddInt64(&s.indexRows, rows)
+	atomic.AddInt64(&s.duplicateIndexKeys, duplicates)
+}
+
+func (s *joinStats) indexGroupRead(g *sortedIndexGroup) {
+	atomic.AddInt64(&s.indexKeys, 1)
+	atomic.AddInt64(&s.indexRows, int64(len(g.entries)))
+	if g.duplicates > 0 {
+		atomic.AddInt64(&s.duplicateIndexKeys, 1)
+	}
+}
+
+// the key the row was joined on, and whether it matched anything
+func joinedKey(results []Result) (string, bool) {
+	var key string
+	for _, res := range results {
+		if res.Left == nil {
+			continue
+		}
+		key = res.Left.Index
+		if res.SuccessfulJoin(JoinTypeInner) {
+			return key, true
+		}
+	}
+	return key, false
+}
+
+func (j *joiner) Stats() Stats {
+	return j.stats.snapshot()
+}
+
+// reports that a row couldn't be joined
+func (j *joiner) rowFailed(rec record, err error) {
+	j.workerRowFailed(0, rec, err)
+}
+
+func (j *joiner) workerRowFailed(worker int, rec record, err error) {
+	j.stats.rowErrored(ErrorCategory(err))
+	rowErr := newRowError(rec, err)
+	rowErr.worker = worker
+	j.errors <- rowErr
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davidporter-id-au/small-join/smalljoin"
+)
+
+// the stats, as they're written out with -stats json
+type statsReport struct {
+	smalljoin.Stats
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	RowsPerSecond  float64 `json:"rows_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// writes the stats for the join out to the file, or stderr if there isn't one
+func writeStats(format string, path string, stats smalljoin.Stats) error {
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if format == "json" {
+		report := statsReport{
+			Stats:          stats,
+			ElapsedSeconds: stats.Elapsed.Seconds(),
+			RowsPerSecond:  stats.RowsPerSecond(),
+			BytesPerSecond: stats.BytesPerSecond(),
+		}
+		return json.NewEncoder(w).Encode(report)
+	}
+	return writeStatsTable(w, stats)
+}
+
+func writeStatsTable(w io.Writer, stats smalljoin.Stats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	row := func(name string, value interface{}) {
+		fmt.Fprintf(tw, "%s\t%v\n", name, value)
+	}
+	row("rows read", stats.LinesRead)
+	row("rows with an empty key", stats.EmptyKey)
+	row("rows matched", stats.Matched)
+	row("rows unmatched", stats.Unmatched)
+	row("rows with errors", stats.Errored)
+	categories := make([]string, 0, len(stats.ErrorsByCategory))
+	for category := range stats.ErrorsByCategory {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		row("  "+category+" errors", stats.ErrorsByCategory[category])
+	}
+	row("distinct keys (estimated)", stats.DistinctKeys)
+	row("index keys", stats.IndexKeys)
+	row("index rows", stats.IndexRows)
+	row("duplicate index keys", stats.DuplicateIndexKeys)
+	row("bytes read", stats.LastOffset)
+	row("elapsed", stats.Elapsed.Round(time.Millisecond))
+	row("rows/sec", fmt.Sprintf("%.0f", stats.RowsPerSecond()))
+	row("bytes/sec", fmt.Sprintf("%.0f", stats.BytesPerSecond()))
+	return tw.Flush()
+}